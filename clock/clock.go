@@ -0,0 +1,89 @@
+// Package clock provides a time source able to be replaced, by the clocktest.Manual one for example.
+package clock
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is a time source.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a Timer sending the current time to its channel after at least d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a time.Timer alike.
+type Timer interface {
+	// C returns a channel the time is sent to on the Timer fired.
+	C() <-chan time.Time
+	// Stop prevents the Timer from firing. Returns false if the Timer has already fired or been stopped.
+	Stop() bool
+}
+
+var _ Clock = Real{}
+
+// Real is the Clock backed by the time package.
+type Real struct{}
+
+// Now returns time.Now()
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer returns time.NewTimer(d) wrapper.
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// WithDeadline is a context.WithDeadline() working with the Clock provided.
+func WithDeadline(parent context.Context, c Clock, d time.Time) (context.Context, context.CancelFunc) {
+	if _, ok := c.(Real); ok {
+		return context.WithDeadline(parent, d)
+	}
+
+	cancelCtx, cancel := context.WithCancel(parent)
+	ctx := &deadlineContext{Context: cancelCtx, deadline: d}
+
+	timer := c.NewTimer(d.Sub(c.Now()))
+	go func() {
+		defer timer.Stop()
+
+		select {
+		case <-timer.C():
+			atomic.StoreInt32(&ctx.exceeded, 1)
+			cancel()
+		case <-cancelCtx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+type deadlineContext struct {
+	context.Context
+	deadline time.Time
+	exceeded int32
+}
+
+func (c *deadlineContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *deadlineContext) Err() error {
+	if atomic.LoadInt32(&c.exceeded) != 0 {
+		return context.DeadlineExceeded
+	}
+
+	return c.Context.Err()
+}
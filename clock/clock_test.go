@@ -0,0 +1,59 @@
+package clock_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/clock/clocktest"
+)
+
+func TestWithDeadline(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := m.Now().Add(time.Hour)
+
+	ctx, cancel := clock.WithDeadline(context.Background(), m, d)
+	defer cancel()
+
+	if actual, ok := ctx.Deadline(); !ok || !actual.Equal(d) {
+		t.Errorf("expected (%v, true), got (%v, %v)", d, actual, ok)
+	}
+
+	m.BlockUntil(1)
+	m.Advance(time.Hour)
+
+	<-ctx.Done()
+	if err := ctx.Err(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestWithDeadlineCanceled(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	ctx, cancel := clock.WithDeadline(context.Background(), m, m.Now().Add(time.Hour))
+	cancel()
+
+	<-ctx.Done()
+	if err := ctx.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestWithDeadlineReal(t *testing.T) {
+	timeout := time.Millisecond * 10
+
+	ctx, cancel := clock.WithDeadline(context.Background(), clock.Real{}, time.Now().Add(timeout))
+	defer cancel()
+
+	timer := clock.Real{}.NewTimer(timeout * 10)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C():
+		t.Errorf("expected the context done in %v", timeout)
+	}
+}
@@ -0,0 +1,159 @@
+// Package clocktest provides a Clock to be used in tests.
+package clocktest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+)
+
+var _ clock.Clock = (*Manual)(nil)
+
+// Manual is a Clock moved manually. Timers fire on the Clock moved to their time.
+type Manual struct {
+	now    time.Time
+	timers map[*timer]struct{}
+	lock   sync.Mutex
+	cond   *sync.Cond
+}
+
+// NewManual creates a Manual clock set to t.
+func NewManual(t time.Time) *Manual {
+	m := &Manual{
+		now:    t,
+		timers: make(map[*timer]struct{}),
+	}
+	m.cond = sync.NewCond(&m.lock)
+
+	return m
+}
+
+// Now returns the current Clock time.
+func (m *Manual) Now() time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.now
+}
+
+// NewTimer creates a Timer firing on the Clock moved d ahead.
+func (m *Manual) NewTimer(d time.Duration) clock.Timer {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	t := &timer{
+		manual: m,
+		at:     m.now.Add(d),
+		c:      make(chan time.Time, 1),
+	}
+
+	if d <= 0 {
+		t.c <- m.now
+		return t
+	}
+
+	m.timers[t] = struct{}{}
+	m.cond.Broadcast()
+
+	return t
+}
+
+// Advance moves the Clock d ahead, firing the Timers in order.
+func (m *Manual) Advance(d time.Duration) {
+	m.Set(m.Now().Add(d))
+}
+
+// Set moves the Clock to t, firing the Timers in order.
+// The Clock never goes back, earlier t is ignored.
+func (m *Manual) Set(t time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	due := make([]*timer, 0, len(m.timers))
+	for tm := range m.timers {
+		if !tm.at.After(t) {
+			due = append(due, tm)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+
+	for _, tm := range due {
+		delete(m.timers, tm)
+		if tm.at.After(m.now) {
+			m.now = tm.at
+		}
+		tm.c <- m.now
+	}
+
+	if t.After(m.now) {
+		m.now = t
+	}
+}
+
+// Timers returns a number of Timers waiting to fire.
+func (m *Manual) Timers() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return len(m.timers)
+}
+
+// BlockUntil blocks until at least n Timers are waiting to fire.
+// Useful to be sure a goroutine is waiting before the Clock is moved.
+func (m *Manual) BlockUntil(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for len(m.timers) < n {
+		m.cond.Wait()
+	}
+}
+
+// Next moves the Clock to the nearest Timer time and fires it.
+// Returns false if there is no Timer waiting.
+func (m *Manual) Next() bool {
+	m.lock.Lock()
+
+	var next *timer
+	for tm := range m.timers {
+		if next == nil || tm.at.Before(next.at) {
+			next = tm
+		}
+	}
+
+	m.lock.Unlock()
+
+	if next == nil {
+		return false
+	}
+
+	m.Set(next.at)
+
+	return true
+}
+
+type timer struct {
+	manual *Manual
+	at     time.Time
+	c      chan time.Time
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *timer) Stop() bool {
+	t.manual.lock.Lock()
+	defer t.manual.lock.Unlock()
+
+	if _, ok := t.manual.timers[t]; !ok {
+		return false
+	}
+
+	delete(t.manual.timers, t)
+
+	return true
+}
@@ -0,0 +1,91 @@
+package clocktest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock/clocktest"
+)
+
+var startTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestAdvance(t *testing.T) {
+	m := clocktest.NewManual(startTime)
+
+	t1 := m.NewTimer(time.Second)
+	t2 := m.NewTimer(time.Second * 2)
+	t3 := m.NewTimer(time.Second * 3)
+
+	if n := m.Timers(); n != 3 {
+		t.Errorf("expected 3, got %d", n)
+	}
+
+	if !t3.Stop() || t3.Stop() {
+		t.Errorf("expected the timer stopped once")
+	}
+
+	m.Advance(time.Second * 2)
+
+	for i, tm := range []struct {
+		c        <-chan time.Time
+		expected time.Time
+	}{
+		{t1.C(), startTime.Add(time.Second)},
+		{t2.C(), startTime.Add(time.Second * 2)},
+	} {
+		select {
+		case actual := <-tm.c:
+			if !actual.Equal(tm.expected) {
+				t.Errorf("%d: expected %v, got %v", i, tm.expected, actual)
+			}
+		default:
+			t.Errorf("%d: expected the timer fired", i)
+		}
+	}
+
+	if t1.Stop() {
+		t.Errorf("expected the fired timer not stopped")
+	}
+
+	if actual, expected := m.Now(), startTime.Add(time.Second*2); !actual.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	m.Set(startTime)
+	if actual, expected := m.Now(), startTime.Add(time.Second*2); !actual.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestBlockUntil(t *testing.T) {
+	m := clocktest.NewManual(startTime)
+
+	done := make(chan time.Time)
+	go func() {
+		done <- <-m.NewTimer(time.Minute).C()
+	}()
+
+	m.BlockUntil(1)
+
+	if !m.Next() {
+		t.Errorf("expected a timer fired")
+	}
+
+	if actual, expected := <-done, startTime.Add(time.Minute); !actual.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	if m.Next() {
+		t.Errorf("expected no timers")
+	}
+}
+
+func TestZeroTimer(t *testing.T) {
+	m := clocktest.NewManual(startTime)
+
+	select {
+	case <-m.NewTimer(0).C():
+	default:
+		t.Errorf("expected the timer fired")
+	}
+}
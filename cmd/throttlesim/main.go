@@ -0,0 +1,141 @@
+// Command throttlesim evaluates a Controller configuration against a traffic trace with a virtual clock,
+// so the limits could be picked before they are deployed.
+//
+// The trace is read from a file, one arrival per line: offset,connection,amount, e.g. 1.5s,conn1,4096.
+// A synthetic trace of the connections demanding the constant rates is used in case -rates is set instead.
+//
+// The output is a per connection achieved throughput, mean and max wait times,
+// time spent throttled, and the Jain's fairness index of the shares of the demand granted.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/onokonem/go-throttledio/limiter"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	var (
+		cfg       config
+		ticks     uint
+		algorithm string
+		burst     int64
+		trace     string
+		rates     string
+		duration  time.Duration
+	)
+
+	flags := flag.NewFlagSet("throttlesim", flag.ContinueOnError)
+	flags.Int64Var(&cfg.commonCPS, "common", 0, "commonCPS, not positive means no limit")
+	flags.Int64Var(&cfg.perChildCPS, "per-child", 0, "perChildCPS, not positive means no limit")
+	flags.DurationVar(&cfg.interval, "interval", 10*time.Second, "measuring interval")
+	flags.UintVar(&ticks, "ticks", 100, "number of ticks the interval is divided to")
+	flags.StringVar(&algorithm, "algorithm", "window", "algorithm: window, bucket or gcra")
+	flags.Int64Var(&burst, "burst", 0, "bucket and gcra burst, not positive means the interval worth")
+	flags.StringVar(&trace, "trace", "", "trace file, - for stdin")
+	flags.StringVar(&rates, "rates", "", "comma separated per connection rates for a synthetic trace")
+	flags.DurationVar(&duration, "duration", 0, "simulation duration, the trace one plus the interval by default")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if ticks == 0 || cfg.interval/time.Duration(ticks) <= 0 {
+		return fmt.Errorf("interval %v, ticks %d: %w", cfg.interval, ticks, limiter.ErrInvalidParams)
+	}
+
+	cfg.ticks = ticks
+
+	switch algorithm {
+	case "window":
+		cfg.algorithm = limiter.SlidingWindow
+	case "bucket":
+		cfg.algorithm = limiter.TokenBucket(burst)
+	case "gcra":
+		cfg.algorithm = limiter.GCRA(burst)
+	default:
+		return fmt.Errorf("algorithm %q unknown", algorithm)
+	}
+
+	arrivals, err := arrivals(trace, rates, duration, cfg.interval/time.Duration(ticks))
+	if err != nil {
+		return err
+	}
+
+	if duration <= 0 {
+		if len(arrivals) > 0 {
+			duration = arrivals[len(arrivals)-1].offset
+		}
+		duration += cfg.interval
+	}
+
+	results := simulate(cfg, arrivals, duration)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "conn\tdemanded\tgranted\trate/s\tmean wait\tmax wait\tthrottled\t")
+
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%v\t%v\t%v\t\n",
+			r.conn, r.demanded, r.granted, r.rate,
+			r.meanWait.Round(time.Millisecond), r.maxWait.Round(time.Millisecond), r.throttled.Round(time.Millisecond),
+		)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "fairness index: %.3f\n", fairness(results))
+
+	return err
+}
+
+// arrivals returns the trace read or the synthetic one.
+func arrivals(trace string, rates string, duration time.Duration, step time.Duration) ([]arrival, error) {
+	switch {
+	case trace != "" && rates != "":
+		return nil, errors.New("either -trace or -rates expected, not both")
+	case rates != "":
+		if duration <= 0 {
+			duration = time.Minute
+		}
+
+		var rs []int64
+		for _, s := range strings.Split(rates, ",") {
+			rate, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil || rate < 0 {
+				return nil, fmt.Errorf("rate %q invalid", s)
+			}
+			rs = append(rs, rate)
+		}
+
+		return synthetic(rs, duration, step), nil
+	case trace == "-":
+		return readTrace(os.Stdin)
+	case trace != "":
+		f, err := os.Open(trace)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return readTrace(f)
+	}
+
+	return nil, errors.New("-trace or -rates expected")
+}
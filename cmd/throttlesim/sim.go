@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock/clocktest"
+	"github.com/onokonem/go-throttledio/limiter"
+)
+
+// config is a Controller configuration to be evaluated.
+type config struct {
+	commonCPS   int64
+	perChildCPS int64
+	interval    time.Duration
+	ticks       uint
+	algorithm   limiter.NewAlgorithm
+}
+
+// result is a connection outcome.
+type result struct {
+	conn      string
+	demanded  int64
+	granted   int64
+	rate      float64 // granted per second of the simulation
+	meanWait  time.Duration
+	maxWait   time.Duration
+	throttled time.Duration // time with some demand pending
+}
+
+// conn is a simulated connection: the demand not granted yet is queued in order of arrival.
+type conn struct {
+	result
+	limiter *limiter.Limiter
+	queue   []arrival
+	waited  float64 // sum of the wait times weighted by the amounts
+}
+
+// simulate runs the arrivals against a Controller with a virtual clock,
+// the pending demand of each connection is asked for every tick.
+// The simulation lasts until duration, the demand still pending then is not granted.
+func simulate(cfg config, arrivals []arrival, duration time.Duration) []result {
+	var (
+		start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		m     = clocktest.NewManual(start)
+		opts  = []limiter.Option{limiter.WithClock(m)}
+	)
+
+	if cfg.algorithm != nil {
+		opts = append(opts, limiter.WithAlgorithm(cfg.algorithm))
+	}
+
+	var (
+		c     = limiter.NewController(cfg.interval, cfg.ticks, cfg.commonCPS, cfg.perChildCPS, opts...)
+		step  = cfg.interval / time.Duration(cfg.ticks)
+		conns = make(map[string]*conn)
+		order []*conn
+	)
+
+	for now := time.Duration(0); now < duration; now += step {
+		for ; len(arrivals) > 0 && arrivals[0].offset <= now; arrivals = arrivals[1:] {
+			a := arrivals[0]
+
+			cn, ok := conns[a.conn]
+			if !ok {
+				cn = &conn{result: result{conn: a.conn}, limiter: c.BornLimiter()}
+				conns[a.conn] = cn
+				order = append(order, cn)
+			}
+
+			cn.demanded += a.amount
+			cn.queue = append(cn.queue, a)
+		}
+
+		for _, cn := range order {
+			cn.ask(now, step)
+		}
+
+		m.Advance(step)
+	}
+
+	results := make([]result, 0, len(order))
+	for _, cn := range order {
+		cn.rate = float64(cn.granted) / duration.Seconds()
+		if cn.granted > 0 {
+			cn.meanWait = time.Duration(cn.waited / float64(cn.granted))
+		}
+		results = append(results, cn.result)
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].conn < results[j].conn })
+
+	return results
+}
+
+// ask asks the Limiter for the demand pending, the oldest arrivals are granted first.
+func (cn *conn) ask(now time.Duration, step time.Duration) {
+	var pending int64
+	for _, a := range cn.queue {
+		pending += a.amount
+	}
+
+	if pending == 0 {
+		return
+	}
+
+	granted := cn.limiter.FillUp(pending)
+	cn.granted += granted
+
+	for granted > 0 {
+		a := &cn.queue[0]
+		n := a.amount
+		if n > granted {
+			n = granted
+		}
+
+		wait := now - a.offset
+		cn.waited += float64(wait) * float64(n)
+		if wait > cn.maxWait {
+			cn.maxWait = wait
+		}
+
+		a.amount -= n
+		granted -= n
+
+		if a.amount == 0 {
+			cn.queue = cn.queue[1:]
+		}
+	}
+
+	if len(cn.queue) > 0 {
+		cn.throttled += step
+	}
+}
+
+// fairness returns the Jain's fairness index of the shares of the demand granted:
+// 1 means all got the same part of their demand, 1/n means one got it all.
+// The connections demanding nothing are skipped.
+func fairness(results []result) float64 {
+	var (
+		n            int
+		sum, squares float64
+	)
+
+	for _, r := range results {
+		if r.demanded <= 0 {
+			continue
+		}
+
+		share := float64(r.granted) / float64(r.demanded)
+		sum += share
+		squares += share * share
+		n++
+	}
+
+	if squares == 0 {
+		return 1
+	}
+
+	return sum * sum / (float64(n) * squares)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	cfg := config{commonCPS: 300, interval: 3 * time.Second, ticks: 30}
+	duration := 30 * time.Second
+
+	results := simulate(cfg, synthetic([]int64{100, 200, 400}, duration, cfg.interval/30), duration)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+
+	// the first one is satisfied, the others share the rest
+	if r := results[0]; r.granted != r.demanded || r.maxWait != 0 {
+		t.Errorf("expected all granted with no wait, got %+v", r)
+	}
+
+	for _, r := range results[1:] {
+		if r.granted >= r.demanded || r.maxWait <= 0 || math.Abs(r.rate-100) > 10 {
+			t.Errorf("expected about 100/s throttled, got %+v", r)
+		}
+	}
+
+	// 1, 1/2 and 1/4 of the demand are granted
+	if f := fairness(results); math.Abs(f-1.75*1.75/(3*1.3125)) > 0.02 {
+		t.Errorf("expected about %f, got %f", 1.75*1.75/(3*1.3125), f)
+	}
+}
+
+func TestSynthetic(t *testing.T) {
+	// 0.1 per step, the fractions are carried forward
+	var total int64
+	for _, a := range synthetic([]int64{1}, 10*time.Second, 100*time.Millisecond) {
+		total += a.amount
+	}
+
+	if total != 10 {
+		t.Errorf("expected 10, got %d", total)
+	}
+}
+
+func TestFairness(t *testing.T) {
+	results := []result{
+		{demanded: 100, granted: 50},
+		{demanded: 400, granted: 200},
+		{demanded: 0, granted: 0},
+	}
+
+	// the same share of the demand is granted, the idle one is skipped
+	if f := fairness(results); math.Abs(f-1) > 1e-9 {
+		t.Errorf("expected 1, got %f", f)
+	}
+}
+
+func TestReadTrace(t *testing.T) {
+	arrivals, err := readTrace(strings.NewReader("# offset,conn,amount\n2s,b,20\n\n1s, a, 10\n"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(arrivals) != 2 || arrivals[0] != (arrival{time.Second, "a", 10}) || arrivals[1] != (arrival{2 * time.Second, "b", 20}) {
+		t.Errorf("unexpected arrivals %+v", arrivals)
+	}
+
+	if _, err := readTrace(strings.NewReader("1s,a\n")); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestRun(t *testing.T) {
+	var out bytes.Buffer
+	if err := run([]string{"-common", "100", "-rates", "50,50", "-duration", "10s", "-algorithm", "gcra"}, &out); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if !strings.Contains(out.String(), "conn2") || !strings.Contains(out.String(), "fairness index: 1.000") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	if err := run([]string{"-algorithm", "unknown", "-rates", "1"}, &out); err == nil {
+		t.Errorf("expected error")
+	}
+}
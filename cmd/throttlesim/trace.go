@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// arrival is an amount a connection demands at the offset from the simulation start.
+type arrival struct {
+	offset time.Duration
+	conn   string
+	amount int64
+}
+
+// readTrace reads the arrivals, one per line: offset,connection,amount.
+// offset is a duration like 1.5s, empty lines and the ones starting with # are skipped.
+// The arrivals are returned sorted by the offset.
+func readTrace(r io.Reader) ([]arrival, error) {
+	var (
+		arrivals []arrival
+		scanner  = bufio.NewScanner(r)
+	)
+
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		fields := strings.Split(s, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: 3 fields expected, got %d", line, len(fields))
+		}
+
+		offset, err := time.ParseDuration(strings.TrimSpace(fields[0]))
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("line %d: offset %q invalid", line, fields[0])
+		}
+
+		amount, err := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+		if err != nil || amount < 0 {
+			return nil, fmt.Errorf("line %d: amount %q invalid", line, fields[2])
+		}
+
+		arrivals = append(arrivals, arrival{offset: offset, conn: strings.TrimSpace(fields[1]), amount: amount})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(arrivals, func(i, j int) bool { return arrivals[i].offset < arrivals[j].offset })
+
+	return arrivals, nil
+}
+
+// synthetic returns the arrivals of the connections demanding the rates provided, each step.
+// Each step brings the amount due by its end less the one brought already,
+// so the fractions are carried forward and the low rates are not lost.
+func synthetic(rates []int64, duration time.Duration, step time.Duration) []arrival {
+	var (
+		arrivals []arrival
+		brought  = make([]int64, len(rates))
+	)
+
+	for offset := time.Duration(0); offset < duration; offset += step {
+		for i, rate := range rates {
+			end := offset + step
+			due := rate*int64(end/time.Second) + rate*int64(end%time.Second)/int64(time.Second)
+
+			arrivals = append(arrivals, arrival{
+				offset: offset,
+				conn:   fmt.Sprintf("conn%d", i+1),
+				amount: due - brought[i],
+			})
+
+			brought[i] = due
+		}
+	}
+
+	return arrivals
+}
@@ -0,0 +1,197 @@
+package bucket
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/internal/conv"
+)
+
+// ErrInvalidState is returned on restoring a state of some other algorithm.
+var ErrInvalidState = errors.New("bucket: state invalid")
+
+// stateKind is the first byte of the Bucket state.
+const stateKind = 'b'
+
+// Bucket is a token bucket: it is refilled with cps tokens per second up to the burst size.
+// cps is provided on every call, the last one seen is used to refill on FillUp.
+type Bucket struct {
+	clock            clock.Clock
+	mtime            time.Time
+	tickDuration     time.Duration
+	intervalDuration time.Duration
+	burst            int64
+	cps              int64
+	tokens           float64
+	lock             sync.Mutex
+}
+
+// NewBucket creates a bucket.
+// interval is a period of time the burst is calculated for in case burst is not positive.
+// ticks is a number of time gaps interval is divided to, the bucket is refilled for a one tick on Reset.
+// burst is a bucket size.
+// clock is a time source.
+func NewBucket(interval time.Duration, ticks uint, burst int64, clock clock.Clock) *Bucket {
+	return &Bucket{
+		clock:            clock,
+		mtime:            clock.Now(),
+		intervalDuration: interval,
+		tickDuration:     interval / time.Duration(ticks),
+		burst:            burst,
+	}
+}
+
+// FillUp takes n tokens unconditionally, negative n returns tokens back.
+// Returns an amount of tokens missing in the bucket.
+func (b *Bucket) FillUp(n int64) int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refillLocked(b.cps)
+	b.tokens -= float64(n)
+
+	return conv.ToInt64(b.capacity(b.cps) - b.tokens)
+}
+
+// FillUpToCap takes up to n tokens available.
+// Returns an actual amount was taken.
+func (b *Bucket) FillUpToCap(n int64, cps int64) int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refillLocked(cps)
+
+	available := conv.ToInt64(math.Floor(math.Min(b.tokens, b.capacity(cps))))
+	switch {
+	case available <= 0:
+		return 0
+	case available > n:
+		available = n
+	}
+
+	b.tokens -= float64(available)
+
+	return available
+}
+
+// Delay returns a time to wait until FillUpToCap(n, cps) is able to take the whole n.
+// n bigger than the bucket is truncated to the bucket size.
+func (b *Bucket) Delay(n int64, cps int64) time.Duration {
+	capacity := b.Capacity(cps)
+
+	switch {
+	case capacity <= 0:
+		return b.intervalDuration
+	case n > capacity:
+		n = capacity
+	case n < 1:
+		n = 1
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refillLocked(cps)
+
+	missing := float64(n) - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+
+	return time.Duration(math.Ceil(missing / float64(cps) * float64(time.Second)))
+}
+
+// Capacity returns the bucket size with cps provided.
+func (b *Bucket) Capacity(cps int64) int64 {
+	return conv.ToInt64(b.capacity(cps))
+}
+
+// Reset the bucket to be used with new cps. The bucket is refilled for a one tick.
+func (b *Bucket) Reset(cps int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.cps = cps
+	b.mtime = b.clock.Now()
+	b.tokens = math.Min(b.capacity(cps), float64(cps)*b.tickDuration.Seconds())
+}
+
+// Resize changes the interval and the ticks.
+// In case the bucket size depends on the interval the tokens are scaled with it,
+// so the part of the bucket used stays the same.
+func (b *Bucket) Resize(interval time.Duration, ticks uint) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refillLocked(b.cps)
+
+	if b.burst <= 0 {
+		b.tokens *= float64(interval) / float64(b.intervalDuration)
+	}
+
+	b.intervalDuration = interval
+	b.tickDuration = interval / time.Duration(ticks)
+}
+
+func (b *Bucket) refillLocked(cps int64) {
+	curTime := b.clock.Now()
+
+	if cps > 0 {
+		b.tokens = math.Min(b.capacity(cps), b.tokens+float64(cps)*curTime.Sub(b.mtime).Seconds())
+	}
+
+	b.cps = cps
+	b.mtime = curTime
+}
+
+func (b *Bucket) capacity(cps int64) float64 {
+	switch {
+	case cps <= 0:
+		return 0
+	case b.burst > 0:
+		return float64(b.burst)
+	}
+
+	return math.Min(float64(cps)*b.intervalDuration.Seconds(), conv.MaxFloat64Int64)
+}
+
+// MarshalBinary returns the Bucket state: the last refill time, cps and the tokens.
+func (b *Bucket) MarshalBinary() ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	data := make([]byte, 1+8*3)
+	data[0] = stateKind
+	binary.BigEndian.PutUint64(data[1:], uint64(b.mtime.UnixNano()))
+	binary.BigEndian.PutUint64(data[9:], uint64(b.cps))
+	binary.BigEndian.PutUint64(data[17:], math.Float64bits(b.tokens))
+
+	return data, nil
+}
+
+// UnmarshalBinary restores the state returned by MarshalBinary.
+// The bucket is refilled for the time passed since on the next use, as usual.
+func (b *Bucket) UnmarshalBinary(data []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(data) != 1+8*3 || data[0] != stateKind {
+		return ErrInvalidState
+	}
+
+	// the state from the future is treated as taken now
+	mtime := time.Unix(0, int64(binary.BigEndian.Uint64(data[1:])))
+	if curTime := b.clock.Now(); mtime.After(curTime) {
+		mtime = curTime
+	}
+
+	b.mtime = mtime
+	b.cps = int64(binary.BigEndian.Uint64(data[9:]))
+	b.tokens = math.Float64frombits(binary.BigEndian.Uint64(data[17:]))
+
+	return nil
+}
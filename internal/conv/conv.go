@@ -0,0 +1,17 @@
+// Package conv converts the float64 amounts to int64 safely.
+package conv
+
+// MaxFloat64Int64 is the biggest float64 to be converted to int64 safely.
+const MaxFloat64Int64 = float64(1<<63 - 1024)
+
+// ToInt64 converts v to int64, the values out of the int64 range are clamped to it.
+func ToInt64(v float64) int64 {
+	switch {
+	case v > MaxFloat64Int64:
+		return int64(MaxFloat64Int64)
+	case v < -MaxFloat64Int64:
+		return -int64(MaxFloat64Int64)
+	}
+
+	return int64(v)
+}
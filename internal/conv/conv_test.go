@@ -0,0 +1,30 @@
+package conv_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/onokonem/go-throttledio/internal/conv"
+)
+
+func TestToInt64(t *testing.T) {
+	for _, c := range []struct {
+		v        float64
+		expected int64
+	}{
+		{0, 0},
+		{-1.5, -1},
+		{1.5, 1},
+		{math.MaxInt64, int64(conv.MaxFloat64Int64)},
+		{-math.MaxInt64, -int64(conv.MaxFloat64Int64)},
+		{math.Inf(1), int64(conv.MaxFloat64Int64)},
+	} {
+		if actual := conv.ToInt64(c.v); actual != c.expected {
+			t.Errorf("%v: expected %d, got %d", c.v, c.expected, actual)
+		}
+	}
+
+	if int64(float64(int64(conv.MaxFloat64Int64))) != int64(conv.MaxFloat64Int64) {
+		t.Errorf("%v is not converted exactly", conv.MaxFloat64Int64)
+	}
+}
@@ -1,23 +1,26 @@
 package counter
 
 import (
+	"encoding/binary"
+	"errors"
 	"math"
 	"sync"
 	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/internal/conv"
 )
 
-var maxFloat64Int64 = func() float64 { // nolint: gochecknoglobals
-	for i := int64(math.MaxInt64); i > 0; i-- {
-		if int64(float64(i)) == i {
-			return float64(i)
-		}
-	}
-	panic("unreachable reached")
-}()
+// ErrInvalidState is returned on restoring a state of some other algorithm or ticks number.
+var ErrInvalidState = errors.New("counter: state invalid")
+
+// stateKind is the first byte of the Counter state.
+const stateKind = 'c'
 
 // Counter used to stack up the measures back to the defined period of time.
 // Old measureas are discarded.
 type Counter struct {
+	clock            clock.Clock
 	mtime            time.Time
 	tickDuration     time.Duration
 	intervalDuration time.Duration
@@ -30,10 +33,12 @@ type Counter struct {
 // interval is a perion of time the measuring performed.
 // ticks is a number of time gaps interval will be divided to.
 // More ticks mean more accuracy.
-func NewCounter(interval time.Duration, ticks uint) *Counter {
-	curTime := time.Now()
+// clock is a time source.
+func NewCounter(interval time.Duration, ticks uint, clock clock.Clock) *Counter {
+	curTime := clock.Now()
 	tickDuration := interval / time.Duration(ticks)
 	return &Counter{
+		clock:            clock,
 		mtime:            curTime.Truncate(tickDuration),
 		intervalDuration: interval,
 		tickDuration:     tickDuration,
@@ -56,15 +61,12 @@ func (c *Counter) FillUp(n int64) int64 {
 // FillUpToCap adding a measure to make total/interval ratio no bigger than cps (counts per second).
 // Returns an actual amount was added.
 func (c *Counter) FillUpToCap(n int64, cps int64) int64 {
-	maxByCPS := float64(cps) * c.intervalDuration.Seconds()
-	if maxByCPS > maxFloat64Int64 {
-		maxByCPS = maxFloat64Int64
-	}
+	maxByCPS := c.maxByCPS(cps)
 
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	left := int64(maxByCPS) - c.cleanUpLocked()
+	left := maxByCPS - c.cleanUpLocked()
 
 	switch {
 	case left <= 0:
@@ -78,9 +80,51 @@ func (c *Counter) FillUpToCap(n int64, cps int64) int64 {
 	return left
 }
 
+// Delay returns a time to wait until FillUpToCap(n, cps) is able to add the whole n.
+// n bigger than cps allows for the interval is truncated to that maximum.
+func (c *Counter) Delay(n int64, cps int64) time.Duration {
+	maxByCPS := c.maxByCPS(cps)
+
+	switch {
+	case maxByCPS <= 0:
+		return c.intervalDuration
+	case n > maxByCPS:
+		n = maxByCPS
+	case n < 1:
+		n = 1
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	excess := c.cleanUpLocked() - (maxByCPS - n)
+	if excess <= 0 {
+		return 0
+	}
+
+	// the oldest tick is the next one after the current, it is discarded when the current tick ends
+	for i := 1; i <= len(c.counts); i++ {
+		excess -= c.counts[(c.tick+i)%len(c.counts)]
+		if excess <= 0 {
+			return c.mtime.Add(time.Duration(i) * c.tickDuration).Sub(c.clock.Now())
+		}
+	}
+
+	return c.intervalDuration
+}
+
+// Capacity returns a maximum amount FillUpToCap(n, cps) is able to stack up for the interval.
+func (c *Counter) Capacity(cps int64) int64 {
+	return c.maxByCPS(cps)
+}
+
+func (c *Counter) maxByCPS(cps int64) int64 {
+	return conv.ToInt64(float64(cps) * c.intervalDuration.Seconds())
+}
+
 func (c *Counter) cleanUpLocked() int64 {
 	var (
-		curTime = time.Now()
+		curTime = c.clock.Now()
 		gap     = int(curTime.Sub(c.mtime) / c.tickDuration)
 	)
 
@@ -111,7 +155,7 @@ func (c *Counter) totalLocked() int64 {
 func (c *Counter) Reset(cps int64) {
 	v := math.MaxInt64 / int64(len(c.counts))
 
-	if maxByCPS := float64(cps) * c.intervalDuration.Seconds(); maxByCPS <= maxFloat64Int64 {
+	if maxByCPS := float64(cps) * c.intervalDuration.Seconds(); maxByCPS <= conv.MaxFloat64Int64 {
 		v = int64(maxByCPS) / int64(len(c.counts))
 	}
 
@@ -122,8 +166,123 @@ func (c *Counter) Reset(cps int64) {
 		c.counts[i] = v
 	}
 
-	curTime := time.Now()
+	curTime := c.clock.Now()
 	c.mtime = curTime.Truncate(c.tickDuration)
 	c.tick = int(curTime.Sub(curTime.Truncate(c.intervalDuration)) / c.tickDuration)
 	c.counts[c.tick] = 0
 }
+
+// Resize changes the interval and the ticks keeping the measures taken:
+// they are spread over the new ticks in proportion to the time overlapped.
+// In case the new interval is longer, the time not measured is filled with the average of the measures,
+// so neither the history is lost nor a burst is allowed.
+func (c *Counter) Resize(interval time.Duration, ticks uint) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cleanUpLocked()
+
+	var (
+		curTime      = c.clock.Now()
+		tickDuration = interval / time.Duration(ticks)
+		start        = curTime.Truncate(tickDuration).Add(-time.Duration(ticks-1) * tickDuration)
+		oldStart     = c.mtime.Add(-time.Duration(len(c.counts)-1) * c.tickDuration)
+		sums         = make([]float64, ticks) // the oldest first
+	)
+
+	if start.Before(oldStart) {
+		average := float64(c.totalLocked()) / float64(c.intervalDuration)
+		spread(sums, start, tickDuration, start, oldStart, average*float64(oldStart.Sub(start)))
+	}
+
+	for i := range c.counts {
+		from := oldStart.Add(time.Duration(i) * c.tickDuration)
+		spread(sums, start, tickDuration, from, from.Add(c.tickDuration), float64(c.counts[(c.tick+1+i)%len(c.counts)]))
+	}
+
+	c.intervalDuration = interval
+	c.tickDuration = tickDuration
+	c.mtime = curTime.Truncate(tickDuration)
+	c.tick = int(curTime.Sub(curTime.Truncate(interval)) / tickDuration)
+	c.counts = make([]int64, ticks)
+
+	// rounded cumulatively to keep the total
+	var total, prev float64
+	for i, v := range sums {
+		total = math.Min(total+v, conv.MaxFloat64Int64)
+		c.counts[(c.tick+1+i)%len(c.counts)] = int64(math.Round(total) - prev)
+		prev = math.Round(total)
+	}
+}
+
+// spread adds v measured evenly from-to to the ticks starting at start, the oldest first.
+// The part before start is discarded, the part after the last tick goes to the last one.
+func spread(sums []float64, start time.Time, tickDuration time.Duration, from time.Time, to time.Time, v float64) {
+	span := to.Sub(from)
+	if span <= 0 || v == 0 {
+		return
+	}
+
+	for i := range sums {
+		tickFrom := start.Add(time.Duration(i) * tickDuration)
+		tickTo := tickFrom.Add(tickDuration)
+		if i == len(sums)-1 && to.After(tickTo) {
+			tickTo = to
+		}
+
+		if from.After(tickFrom) {
+			tickFrom = from
+		}
+
+		if to.Before(tickTo) {
+			tickTo = to
+		}
+
+		if overlap := tickTo.Sub(tickFrom); overlap > 0 {
+			sums[i] += v * float64(overlap) / float64(span)
+		}
+	}
+}
+
+// MarshalBinary returns the Counter state: the current tick time and the measures, the oldest first.
+func (c *Counter) MarshalBinary() ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b := make([]byte, 1+8+8*len(c.counts))
+	b[0] = stateKind
+	binary.BigEndian.PutUint64(b[1:], uint64(c.mtime.UnixNano()))
+
+	for i := range c.counts {
+		v := c.counts[(c.tick+1+i)%len(c.counts)]
+		binary.BigEndian.PutUint64(b[9+8*i:], uint64(v))
+	}
+
+	return b, nil
+}
+
+// UnmarshalBinary restores the state returned by MarshalBinary.
+// The measures older than the interval are discarded on the next use, as usual.
+func (c *Counter) UnmarshalBinary(b []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(b) != 1+8+8*len(c.counts) || b[0] != stateKind {
+		return ErrInvalidState
+	}
+
+	// the state from the future is treated as taken now
+	mtime := time.Unix(0, int64(binary.BigEndian.Uint64(b[1:])))
+	if curTime := c.clock.Now(); mtime.After(curTime) {
+		mtime = curTime
+	}
+
+	c.mtime = mtime.Truncate(c.tickDuration)
+	c.tick = int(mtime.Sub(mtime.Truncate(c.intervalDuration)) / c.tickDuration)
+
+	for i := range c.counts {
+		c.counts[(c.tick+1+i)%len(c.counts)] = int64(binary.BigEndian.Uint64(b[9+8*i:]))
+	}
+
+	return nil
+}
@@ -8,6 +8,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/clock/clocktest"
 	"github.com/onokonem/go-throttledio/internal/counter"
 )
 
@@ -41,7 +43,7 @@ func (s *testTicks) append(v testTick) {
 func TestFillUpRandom(t *testing.T) {
 	toCheck := &testTicks{ticks: make([]testTick, 0, 500)}
 
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 
 	wg := sync.WaitGroup{}
 	wg.Add(concurency)
@@ -81,7 +83,7 @@ func TestFillUpRandom(t *testing.T) {
 func TestFillUpShort(t *testing.T) {
 	toCheck := &testTicks{ticks: make([]testTick, 0, 500)}
 
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 
 	wg := sync.WaitGroup{}
 	wg.Add(concurency)
@@ -119,7 +121,7 @@ func TestFillUpShort(t *testing.T) {
 }
 
 func TestFillUpLong(t *testing.T) {
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 
 	for end := time.Now().Add(interval * 3 / 2); end.After(time.Now()); time.Sleep(interval / ticks * 3 / 4) {
 		c.FillUp(int64(rand.Int63n(1500) + 1))
@@ -136,7 +138,7 @@ func TestFillUpLong(t *testing.T) {
 }
 
 func TestFillUpToCap(t *testing.T) {
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 
 	cps := int64(100)
 	total := int64(float64(cps) * interval.Seconds())
@@ -171,7 +173,7 @@ func TestFillUpToCap(t *testing.T) {
 }
 
 func TestFillUpToCapZeroCPS(t *testing.T) {
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 	n := rand.Int63n(1500)
 
 	expected := int64(0)
@@ -181,7 +183,7 @@ func TestFillUpToCapZeroCPS(t *testing.T) {
 }
 
 func TestFillUpToCapMaxCPS(t *testing.T) {
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 	n := rand.Int63n(1500)
 
 	expected := n
@@ -191,7 +193,7 @@ func TestFillUpToCapMaxCPS(t *testing.T) {
 }
 
 func TestFillUpToCapNegativeCPS(t *testing.T) {
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 	n := rand.Int63n(1500)
 
 	expected := int64(0)
@@ -201,7 +203,7 @@ func TestFillUpToCapNegativeCPS(t *testing.T) {
 }
 
 func TestReset(t *testing.T) {
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 
 	cps := int64(100)
 
@@ -213,6 +215,110 @@ func TestReset(t *testing.T) {
 	}
 }
 
+func TestState(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Truncate(interval))
+	tick := interval / ticks
+
+	c := counter.NewCounter(interval, ticks, m)
+	c.FillUp(10)
+	m.Advance(tick)
+	c.FillUp(20)
+
+	b, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	m.Advance(tick)
+
+	restored := counter.NewCounter(interval, ticks, m)
+	if err := restored.UnmarshalBinary(b); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if actual := restored.FillUp(0); actual != 30 {
+		t.Errorf("expected 30, got %d", actual)
+	}
+
+	// the first measure is out of the interval
+	m.Advance(interval - tick*2)
+
+	if actual := restored.FillUp(0); actual != 20 {
+		t.Errorf("expected 20, got %d", actual)
+	}
+
+	if err := counter.NewCounter(interval, ticks+1, m).UnmarshalBinary(b); err != counter.ErrInvalidState {
+		t.Errorf("expected %v, got %v", counter.ErrInvalidState, err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Truncate(interval))
+	tick := interval / ticks
+
+	c := counter.NewCounter(interval, ticks, m)
+	for i := 0; i < ticks; i++ {
+		if i > 0 {
+			m.Advance(tick)
+		}
+		c.FillUp(10)
+	}
+
+	// the time not measured is filled with the average
+	c.Resize(interval*2, ticks)
+
+	if actual := c.FillUp(0); actual != 200 {
+		t.Errorf("expected 200, got %d", actual)
+	}
+
+	// the last 1.35s and the current tick are kept, 20 per 0.6s
+	c.Resize(interval/2, ticks)
+
+	if actual := c.FillUp(0); actual != 55 {
+		t.Errorf("expected 55, got %d", actual)
+	}
+
+	m.Advance(interval / 2)
+
+	if actual := c.FillUp(0); actual != 0 {
+		t.Errorf("expected 0, got %d", actual)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	c := counter.NewCounter(interval, ticks, clock.Real{})
+
+	cps := int64(100)
+	total := int64(float64(cps) * interval.Seconds())
+
+	if actual := c.Delay(total, cps); actual != 0 {
+		t.Errorf("expected 0, got %v", actual)
+	}
+
+	c.FillUpToCap(total, cps)
+
+	delay := c.Delay(1, cps)
+	if delay <= 0 || delay > interval {
+		t.Errorf("expected (0, %v], got %v", interval, delay)
+	}
+
+	time.Sleep(delay)
+
+	expected := total
+	if actual := c.FillUpToCap(total, cps); actual != expected {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+}
+
+func TestDelayZeroCPS(t *testing.T) {
+	c := counter.NewCounter(interval, ticks, clock.Real{})
+
+	expected := interval
+	if actual := c.Delay(1, 0); actual != expected {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
 // 10%  0-5ms
 // 85%  30-100ms
 // 5%  1000-3500ms
@@ -241,28 +347,28 @@ func randomDelay() time.Duration {
 }
 
 func BenchmarkFillUpConst(b *testing.B) {
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 	for i := 0; i < b.N; i++ {
 		c.FillUp(int64(i))
 	}
 }
 
 func BenchmarkFillUpRand(b *testing.B) {
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 	for i := 0; i < b.N; i++ {
 		c.FillUp(rand.Int63n(1500))
 	}
 }
 
 func BenchmarkFillUpToCapConst(b *testing.B) {
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 	for i := 0; i < b.N; i++ {
 		c.FillUpToCap(1, 10000)
 	}
 }
 
 func BenchmarkFillUpToCapRand(b *testing.B) {
-	c := counter.NewCounter(interval, ticks)
+	c := counter.NewCounter(interval, ticks, clock.Real{})
 	for i := 0; i < b.N; i++ {
 		c.FillUpToCap(rand.Int63n(1500), 10000)
 	}
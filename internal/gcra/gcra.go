@@ -0,0 +1,207 @@
+package gcra
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/internal/conv"
+)
+
+// ErrInvalidState is returned on restoring a state of some other algorithm.
+var ErrInvalidState = errors.New("gcra: state invalid")
+
+// stateKind is the first byte of the GCRA state.
+const stateKind = 'g'
+
+// GCRA is a generic cell rate algorithm implementation.
+// It tracks a theoretical arrival time (TAT) of the next unit,
+// a unit conforms in case the TAT is no more than a burst tolerance ahead of now.
+// cps is provided on every call, the last one seen is used on FillUp.
+type GCRA struct {
+	clock            clock.Clock
+	base             time.Time
+	tickDuration     time.Duration
+	intervalDuration time.Duration
+	burst            int64
+	cps              int64
+	tat              float64 // nanoseconds since base
+	lock             sync.Mutex
+}
+
+// NewGCRA creates a GCRA instance.
+// interval is a period of time the burst is calculated for in case burst is not positive.
+// ticks is a number of time gaps interval is divided to, a one tick worth is allowed on Reset.
+// burst is a number of units allowed to conform at once.
+// clock is a time source.
+func NewGCRA(interval time.Duration, ticks uint, burst int64, clock clock.Clock) *GCRA {
+	return &GCRA{
+		clock:            clock,
+		base:             clock.Now(),
+		intervalDuration: interval,
+		tickDuration:     interval / time.Duration(ticks),
+		burst:            burst,
+	}
+}
+
+// FillUp moves the TAT for n units unconditionally, negative n moves it back.
+// Returns an amount of units the TAT is ahead of now.
+func (g *GCRA) FillUp(n int64) int64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := g.nowLocked()
+	if g.cps <= 0 {
+		return 0
+	}
+
+	g.tat = math.Max(g.tat, now) + float64(n)*g.emission(g.cps)
+
+	return conv.ToInt64((g.tat - now) / g.emission(g.cps))
+}
+
+// FillUpToCap moves the TAT for up to n units conforming.
+// Returns an actual amount was conforming.
+func (g *GCRA) FillUpToCap(n int64, cps int64) int64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.cps = cps
+	if cps <= 0 {
+		return 0
+	}
+
+	var (
+		now       = g.nowLocked()
+		tat       = math.Max(g.tat, now)
+		emission  = g.emission(cps)
+		available = conv.ToInt64(math.Floor(g.capacity(cps) - (tat-now)/emission))
+	)
+
+	switch {
+	case available <= 0:
+		return 0
+	case available > n:
+		available = n
+	}
+
+	g.tat = tat + float64(available)*emission
+
+	return available
+}
+
+// Delay returns a time to wait until FillUpToCap(n, cps) is able to accept the whole n.
+// n bigger than the burst is truncated to the burst.
+func (g *GCRA) Delay(n int64, cps int64) time.Duration {
+	capacity := g.Capacity(cps)
+
+	switch {
+	case capacity <= 0:
+		return g.intervalDuration
+	case n > capacity:
+		n = capacity
+	case n < 1:
+		n = 1
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	var (
+		now      = g.nowLocked()
+		emission = g.emission(cps)
+		wait     = math.Max(g.tat, now) + float64(n)*emission - g.capacity(cps)*emission - now
+	)
+
+	if wait <= 0 {
+		return 0
+	}
+
+	return time.Duration(math.Ceil(wait))
+}
+
+// Capacity returns the burst with cps provided.
+func (g *GCRA) Capacity(cps int64) int64 {
+	return conv.ToInt64(g.capacity(cps))
+}
+
+// Reset the TAT to be used with new cps. A one tick worth is allowed.
+func (g *GCRA) Reset(cps int64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.cps = cps
+	if cps <= 0 {
+		return
+	}
+
+	capacity := g.capacity(cps)
+	g.tat = g.nowLocked() + (capacity-math.Min(capacity, float64(cps)*g.tickDuration.Seconds()))*g.emission(cps)
+}
+
+// Resize changes the interval and the ticks.
+// In case the burst depends on the interval the TAT ahead of now is scaled with it,
+// so the part of the burst used stays the same.
+func (g *GCRA) Resize(interval time.Duration, ticks uint) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if now := g.nowLocked(); g.burst <= 0 && g.tat > now {
+		g.tat = now + (g.tat-now)*float64(interval)/float64(g.intervalDuration)
+	}
+
+	g.intervalDuration = interval
+	g.tickDuration = interval / time.Duration(ticks)
+}
+
+func (g *GCRA) nowLocked() float64 {
+	return float64(g.clock.Now().Sub(g.base))
+}
+
+// emission is a time in nanoseconds one unit takes with cps.
+func (g *GCRA) emission(cps int64) float64 {
+	return float64(time.Second) / float64(cps)
+}
+
+func (g *GCRA) capacity(cps int64) float64 {
+	switch {
+	case cps <= 0:
+		return 0
+	case g.burst > 0:
+		return float64(g.burst)
+	}
+
+	return math.Min(float64(cps)*g.intervalDuration.Seconds(), conv.MaxFloat64Int64)
+}
+
+// MarshalBinary returns the GCRA state: cps and the absolute TAT.
+func (g *GCRA) MarshalBinary() ([]byte, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	data := make([]byte, 1+8*2)
+	data[0] = stateKind
+	binary.BigEndian.PutUint64(data[1:], uint64(g.cps))
+	binary.BigEndian.PutUint64(data[9:], uint64(g.base.Add(time.Duration(g.tat)).UnixNano()))
+
+	return data, nil
+}
+
+// UnmarshalBinary restores the state returned by MarshalBinary.
+// The TAT passed already means nothing is carried over, as usual.
+func (g *GCRA) UnmarshalBinary(data []byte) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if len(data) != 1+8*2 || data[0] != stateKind {
+		return ErrInvalidState
+	}
+
+	g.cps = int64(binary.BigEndian.Uint64(data[1:]))
+	g.tat = float64(time.Unix(0, int64(binary.BigEndian.Uint64(data[9:]))).Sub(g.base))
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package gcra_test
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/clock/clocktest"
+	"github.com/onokonem/go-throttledio/internal/gcra"
+)
+
+const (
+	interval = time.Second * 3
+	ticks    = 10
+)
+
+func TestFillUpToCap(t *testing.T) {
+	cps := int64(1000)
+	burst := int64(100)
+
+	b := gcra.NewGCRA(interval, ticks, burst, clock.Real{})
+	b.Reset(cps)
+
+	n := int64(140)
+
+	expected := burst
+	if actual := b.FillUpToCap(n, cps); actual != expected {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+
+	expected = 0
+	if actual := b.FillUpToCap(n, cps); actual != expected {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+
+	delay := b.Delay(n, cps)
+	if max := time.Second * time.Duration(burst) / time.Duration(cps); delay <= 0 || delay > max {
+		t.Errorf("expected (0, %v], got %v", max, delay)
+	}
+
+	time.Sleep(delay)
+
+	expected = burst
+	if actual := b.FillUpToCap(n, cps); actual != expected {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+}
+
+func TestFillUp(t *testing.T) {
+	cps := int64(1)
+	burst := int64(100)
+
+	b := gcra.NewGCRA(interval, ticks, burst, clock.Real{})
+	b.Reset(cps)
+
+	b.FillUpToCap(burst, cps)
+
+	expected := int64(50)
+	b.FillUp(-expected)
+	if actual := b.FillUpToCap(burst, cps); actual != expected {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+}
+
+func TestReset(t *testing.T) {
+	cps := int64(100)
+
+	b := gcra.NewGCRA(interval, ticks, 0, clock.Real{})
+	b.Reset(cps)
+
+	expected := int64(float64(cps) * interval.Seconds() / ticks)
+	if actual := b.FillUpToCap(1000000, cps); actual != expected {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+}
+
+func TestState(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cps := int64(100)
+
+	a := gcra.NewGCRA(interval, ticks, 0, m)
+	a.Reset(cps)
+	a.FillUpToCap(1000000, cps)
+
+	b, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	m.Advance(time.Second)
+
+	restored := gcra.NewGCRA(interval, ticks, 0, m)
+	if err := restored.UnmarshalBinary(b); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// a second worth is refilled since the state was taken
+	if actual := restored.FillUpToCap(1000000, cps); actual != cps {
+		t.Errorf("expected %d, got %d", cps, actual)
+	}
+
+	if err := restored.UnmarshalBinary(b[1:]); err != gcra.ErrInvalidState {
+		t.Errorf("expected %v, got %v", gcra.ErrInvalidState, err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cps := int64(100)
+
+	b := gcra.NewGCRA(interval, ticks, 0, m)
+	b.Reset(cps)
+	b.FillUpToCap(1000000, cps)
+
+	m.Advance(time.Second)
+
+	// a second worth of 3 is free, so is the same part of 6
+	b.Resize(interval*2, ticks)
+
+	if actual := b.FillUpToCap(1000000, cps); actual != 2*cps {
+		t.Errorf("expected %d, got %d", 2*cps, actual)
+	}
+
+	m.Advance(time.Second)
+
+	// a second worth of 6 is free, so is the same part of 1.5
+	b.Resize(interval/2, ticks)
+
+	if actual := b.FillUpToCap(1000000, cps); actual != cps/4 {
+		t.Errorf("expected %d, got %d", cps/4, actual)
+	}
+}
+
+func TestFillUpToCapZeroCPS(t *testing.T) {
+	b := gcra.NewGCRA(interval, ticks, 100, clock.Real{})
+	b.Reset(0)
+	n := rand.Int63n(1500)
+
+	expected := int64(0)
+	if actual := b.FillUpToCap(n, 0); actual != expected {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+
+	if actual := b.Delay(n, 0); actual != interval {
+		t.Errorf("expected %v, got %v", interval, actual)
+	}
+}
+
+func TestFillUpToCapMaxCPS(t *testing.T) {
+	b := gcra.NewGCRA(interval, ticks, 0, clock.Real{})
+	b.Reset(math.MaxInt64)
+	n := rand.Int63n(1500)
+
+	expected := n
+	if actual := b.FillUpToCap(n, math.MaxInt64); actual != expected {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+}
+
+func BenchmarkFillUpToCapConst(b *testing.B) {
+	c := gcra.NewGCRA(interval, ticks, 0, clock.Real{})
+	for i := 0; i < b.N; i++ {
+		c.FillUpToCap(1, 10000)
+	}
+}
@@ -0,0 +1,73 @@
+package limiter
+
+import (
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/internal/bucket"
+	"github.com/onokonem/go-throttledio/internal/counter"
+	"github.com/onokonem/go-throttledio/internal/gcra"
+)
+
+// Algorithm is a rate accounting strategy used by the Controller and the Limiters.
+// cps (counts per second) is provided on every call as it could be changed at any time.
+type Algorithm interface {
+	// FillUp adds n unconditionally, negative n returns the amount back.
+	FillUp(n int64) int64
+	// FillUpToCap adds up to n not exceeding cps. Returns an actual amount was added.
+	FillUpToCap(n int64, cps int64) int64
+	// Delay returns a time to wait until FillUpToCap(n, cps) is able to add the whole n.
+	Delay(n int64, cps int64) time.Duration
+	// Capacity returns a maximum amount FillUpToCap is able to add at once with cps.
+	Capacity(cps int64) int64
+	// Reset the state to be used with new cps.
+	Reset(cps int64)
+}
+
+var (
+	_ Algorithm = (*counter.Counter)(nil)
+	_ Algorithm = (*bucket.Bucket)(nil)
+	_ Algorithm = (*gcra.GCRA)(nil)
+)
+
+// Resizer is an Algorithm able to change the interval and the ticks keeping the state, see Controller.Reconfigure.
+// All the algorithms provided are.
+type Resizer interface {
+	Resize(interval time.Duration, ticks uint)
+}
+
+var (
+	_ Resizer = (*counter.Counter)(nil)
+	_ Resizer = (*bucket.Bucket)(nil)
+	_ Resizer = (*gcra.GCRA)(nil)
+)
+
+// NewAlgorithm creates an Algorithm instance.
+// interval is a period of time measuring is performed.
+// ticks is a number of gaps interval is divided to.
+// clock is a time source.
+type NewAlgorithm func(interval time.Duration, ticks uint, clock clock.Clock) Algorithm
+
+// SlidingWindow creates the default algorithm: a sum over the interval is limited.
+// Each tick the oldest measure is discarded.
+func SlidingWindow(interval time.Duration, ticks uint, clock clock.Clock) Algorithm {
+	return counter.NewCounter(interval, ticks, clock)
+}
+
+// TokenBucket returns a token bucket algorithm with burst size provided.
+// The bucket is refilled with cps tokens per second.
+// Not positive burst means the amount cps allows for the interval.
+func TokenBucket(burst int64) NewAlgorithm {
+	return func(interval time.Duration, ticks uint, clock clock.Clock) Algorithm {
+		return bucket.NewBucket(interval, ticks, burst, clock)
+	}
+}
+
+// GCRA returns a generic cell rate algorithm with burst size provided.
+// Units are spaced 1/cps seconds apart, up to burst units are allowed to come at once.
+// Not positive burst means the amount cps allows for the interval.
+func GCRA(burst int64) NewAlgorithm {
+	return func(interval time.Duration, ticks uint, clock clock.Clock) Algorithm {
+		return gcra.NewGCRA(interval, ticks, burst, clock)
+	}
+}
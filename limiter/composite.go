@@ -0,0 +1,182 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+)
+
+// Dimension is a Limiter applied by a Composite with a cost: an amount n costs PerCall + PerUnit*n units of it.
+// E.g. {bytes, 0, 1} limits the bandwidth, {ops, 1, 0} limits the IOPS.
+type Dimension struct {
+	Limiter *Limiter
+	PerCall int64
+	PerUnit int64
+}
+
+func (d Dimension) cost(n int64) int64 {
+	return d.PerCall + d.PerUnit*n
+}
+
+// units returns an amount the cost granted is enough for, up to n.
+func (d Dimension) units(granted int64, n int64) int64 {
+	switch {
+	case granted < d.PerCall:
+		return 0
+	case d.PerUnit <= 0:
+		return n
+	}
+
+	return minInt64((granted-d.PerCall)/d.PerUnit, n)
+}
+
+// Composite is a set of Dimensions enforced simultaneously, e.g. bytes/s, ops/s and messages/s of the same stream.
+// An amount is granted in case all the Dimensions grant its cost, partial grants are returned back.
+// A Read or Write of readwrite with the Composite consumes PerCall plus n*PerUnit of each Dimension.
+type Composite struct {
+	dims []Dimension
+}
+
+// NewComposite creates a Composite of the Dimensions provided, the clock of the first one is used.
+// Panics with ErrInvalidParams in case there are no Dimensions, a Dimension has no Limiter or costs nothing.
+func NewComposite(dims ...Dimension) *Composite {
+	if len(dims) == 0 {
+		panic(fmt.Errorf("dimensions: %d: %w", len(dims), ErrInvalidParams))
+	}
+
+	for i, d := range dims {
+		if d.Limiter == nil || d.PerCall < 0 || d.PerUnit < 0 || d.cost(1) <= 0 {
+			panic(fmt.Errorf("dimension %d: %+v: %w", i, d, ErrInvalidParams))
+		}
+	}
+
+	return &Composite{dims: dims}
+}
+
+// Dimensions returns the Dimensions of the Composite.
+func (c *Composite) Dimensions() []Dimension {
+	return c.dims
+}
+
+// Clock returns a time source of the first Dimension.
+func (c *Composite) Clock() clock.Clock {
+	return c.dims[0].Limiter.Clock()
+}
+
+// FillUp checks the cost of n against all the Dimensions and returns an amount all of them are granting.
+// EventThrottled is reported in case less than n is granted.
+// Not positive n returns PerUnit*n back to all the Dimensions, the per call costs are not returned.
+func (c *Composite) FillUp(n int64) int64 {
+	if n <= 0 {
+		for _, d := range c.dims {
+			if d.PerUnit > 0 {
+				d.Limiter.FillUp(d.PerUnit * n)
+			}
+		}
+		return n
+	}
+
+	allowed := c.grant(n)
+	c.record(n, allowed)
+
+	if allowed < n {
+		c.Report(Event{Kind: EventThrottled, Requested: n, Granted: allowed})
+	}
+
+	return allowed
+}
+
+// grant checks the cost of n against all the Dimensions, the costs over the amount granted by all are returned back.
+func (c *Composite) grant(n int64) int64 {
+	allowed := n
+	taken := make([]int64, len(c.dims))
+
+	for i, d := range c.dims {
+		taken[i] = d.Limiter.grant(d.cost(allowed))
+		if allowed = d.units(taken[i], allowed); allowed <= 0 {
+			break
+		}
+	}
+
+	for i, d := range c.dims {
+		excess := taken[i]
+		if allowed > 0 {
+			excess -= d.cost(allowed)
+		}
+
+		if excess > 0 {
+			d.Limiter.add(-excess)
+		}
+	}
+
+	return maxInt64(allowed, 0)
+}
+
+// WaitN blocks until all the Dimensions are able to grant the cost of some of n and returns an actual amount granted.
+// Returns ctx.Err() in case ctx is done before anything was granted,
+// and ErrQuotaExhausted in case nothing is left until a quota renewal.
+// Time spent waiting is reported to all the Limiters stats as throttled, and to the hooks with EventThrottled.
+func (c *Composite) WaitN(ctx context.Context, n int64) (int64, error) {
+	return waitN(ctx, c, n)
+}
+
+// record reports the costs of a request of n and of an amount granted to all the Dimensions stats.
+func (c *Composite) record(n, granted int64) {
+	for _, d := range c.dims {
+		var requestedCost, grantedCost int64
+		if n > 0 {
+			requestedCost = d.cost(n)
+		}
+		if granted > 0 {
+			grantedCost = d.cost(granted)
+		}
+
+		d.Limiter.record(requestedCost, grantedCost)
+	}
+}
+
+// throttle reports a time spent waiting to all the Dimensions stats.
+func (c *Composite) throttle(d time.Duration) {
+	for _, dim := range c.dims {
+		dim.Limiter.throttle(d)
+	}
+}
+
+// QuotaLeft returns the least amount the quotas left of all the Dimensions are enough for, and the renewal time.
+func (c *Composite) QuotaLeft() (int64, time.Time) {
+	var (
+		left    int64 = math.MaxInt64
+		resetAt time.Time
+	)
+
+	for _, d := range c.dims {
+		dl, dr := d.Limiter.QuotaLeft()
+		if dl = d.units(dl, math.MaxInt64); dl < left {
+			left, resetAt = dl, dr
+		}
+	}
+
+	return left, resetAt
+}
+
+// Report passes the event to all the Limiters.
+func (c *Composite) Report(e Event) {
+	for _, d := range c.dims {
+		d.Limiter.Report(e)
+	}
+}
+
+// delay returns a time to wait until all the Dimensions are able to grant the cost of n.
+func (c *Composite) delay(n int64) time.Duration {
+	d := time.Duration(0)
+	for _, dim := range c.dims {
+		if dd := dim.Limiter.delay(dim.cost(n)); dd > d {
+			d = dd
+		}
+	}
+
+	return d
+}
@@ -4,24 +4,61 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/onokonem/go-throttledio/internal/counter"
+	"github.com/onokonem/go-throttledio/clock"
 )
 
 // Errors
 var (
-	ErrInvalidParams = errors.New("parameter invalid")
+	ErrInvalidParams  = errors.New("parameter invalid")
+	ErrQuotaExhausted = errors.New("quota exhausted")
+	ErrOvercommitted  = errors.New("guaranteed rates exceed commonCPS")
 )
 
 // Controller is a struct to create and control Limiters.
 type Controller struct {
-	interval    time.Duration
-	ticks       uint
-	counter     *counter.Counter
-	commonCPS   int64
-	perChildCPS int64
+	parent       *Controller
+	interval     int64 // time.Duration, could be changed by Reconfigure
+	ticks        int64
+	clock        clock.Clock
+	newAlgorithm NewAlgorithm
+	counter      Algorithm
+	deferred     deferred
+	fair         *fairShare
+	floors       *floors
+	stats        *stats
+	named        sync.Map // of *stats by the Limiter name
+	quota        *quota
+	limiters     map[*Limiter]struct{}
+	children     map[*Controller]struct{}
+	stopSchedule chan struct{}
+	hook         atomic.Value
+	lock         sync.Mutex
+	commonCPS    int64
+	perChildCPS  int64
+	swept        int64 // unix nano time the idle Limiters were dropped
+}
+
+// Option is a Controller option.
+type Option func(*Controller)
+
+// WithAlgorithm sets an algorithm the Controller and the derrived Limiters are using.
+// SlidingWindow is used by default.
+func WithAlgorithm(newAlgorithm NewAlgorithm) Option {
+	return func(c *Controller) {
+		c.newAlgorithm = newAlgorithm
+	}
+}
+
+// WithClock sets a time source the Controller and the derrived Limiters are using.
+// clock.Real is used by default.
+func WithClock(clock clock.Clock) Option {
+	return func(c *Controller) {
+		c.clock = clock
+	}
 }
 
 // NewController creates a new controller instance.
@@ -31,7 +68,8 @@ type Controller struct {
 // perChildCPS is a default value for each derrived Limiter.
 // Note: each Limiter have 3 limits: it's own one, perChildCPS, and commonCPS. Minimal one is applied in any case.
 // commonCPS is a limit for all the derrived Limiters together.
-func NewController(interval time.Duration, ticks uint, commonCPS int64, perChildCPS int64) *Controller {
+// opts are applied in order provided.
+func NewController(interval time.Duration, ticks uint, commonCPS int64, perChildCPS int64, opts ...Option) *Controller {
 	if commonCPS <= 0 {
 		commonCPS = math.MaxInt64
 	}
@@ -45,31 +83,215 @@ func NewController(interval time.Duration, ticks uint, commonCPS int64, perChild
 	}
 
 	c := &Controller{
-		interval:    interval,
-		ticks:       ticks,
-		counter:     counter.NewCounter(interval, ticks),
-		commonCPS:   commonCPS,
-		perChildCPS: perChildCPS,
+		interval:     int64(interval),
+		ticks:        int64(ticks),
+		clock:        clock.Real{},
+		newAlgorithm: SlidingWindow,
+		fair:         newFairShare(),
+		floors:       newFloors(),
+		quota:        newQuota(),
+		limiters:     make(map[*Limiter]struct{}),
+		children:     make(map[*Controller]struct{}),
+		commonCPS:    commonCPS,
+		perChildCPS:  perChildCPS,
+	}
+
+	for _, opt := range opts {
+		opt(c)
 	}
 
+	c.counter = c.newAlgorithm(interval, ticks, c.clock)
+	c.stats = newStats(interval, ticks, c.clock)
 	c.counter.Reset(commonCPS)
 
 	return c
 }
 
-// BornLimiter returns a new limiter
+// BornController returns a new Controller nested into c.
+// Limiters derrived from the new Controller are limited by all the Controllers up to the root one:
+// commonCPS of each Controller is applied, and perChildCPS is a minimal one along the chain.
+// Not positive commonCPS or perChildCPS means no own limit, so the parent ones are applied only.
+// The new Controller uses the interval, ticks, clock and algorithm of c.
+func (c *Controller) BornController(commonCPS int64, perChildCPS int64) *Controller {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	interval, ticks := c.Window()
+	child := NewController(interval, ticks, commonCPS, perChildCPS, WithClock(c.clock), WithAlgorithm(c.newAlgorithm))
+	child.parent = c
+
+	c.children[child] = struct{}{}
+
+	return child
+}
+
+// Release detaches the Controller from the parent one, so perChildCPS changes are not propagated to it anymore.
+// The Controller is still limited by the parent ones.
+func (c *Controller) Release() {
+	if c.parent == nil {
+		return
+	}
+
+	c.parent.lock.Lock()
+	defer c.parent.lock.Unlock()
+
+	delete(c.parent.children, c)
+}
+
+// Clock returns a time source the Controller is using.
+func (c *Controller) Clock() clock.Clock {
+	return c.clock
+}
+
+// Window returns the interval measuring is performed for and the number of ticks it is divided to.
+func (c *Controller) Window() (time.Duration, uint) {
+	return time.Duration(atomic.LoadInt64(&c.interval)), uint(atomic.LoadInt64(&c.ticks))
+}
+
+func (c *Controller) intervalDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.interval))
+}
+
+// Parent returns the Controller c was born from, nil for the root one.
+func (c *Controller) Parent() *Controller {
+	return c.parent
+}
+
+// childCPS returns a minimal perChildCPS along the chain up to the root Controller.
+func (c *Controller) childCPS() int64 {
+	cps := atomic.LoadInt64(&c.perChildCPS)
+	for p := c.parent; p != nil; p = p.parent {
+		cps = minInt64(cps, atomic.LoadInt64(&p.perChildCPS))
+	}
+
+	return cps
+}
+
+// BornLimiter returns a new limiter.
+// The Limiter is registered in the Controller until released or idle for the interval.
+// The idle one is registered back on the next use, so the Limiters not released are garbage collected still.
 func (c *Controller) BornLimiter() *Limiter {
+	now := c.clock.Now()
+	c.sweep(now)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	interval, ticks := c.Window()
 	l := &Limiter{
 		controller: c,
-		counter:    counter.NewCounter(c.interval, c.ticks),
-		cps:        atomic.LoadInt64(&c.perChildCPS),
+		counter:    c.newAlgorithm(interval, ticks, c.clock),
+		stats:      newStats(interval, ticks, c.clock),
+		quota:      newQuota(),
+		cps:        math.MaxInt64,
+		weight:     1,
+		used:       now.UnixNano(),
+		registered: 1,
 	}
 
-	l.counter.Reset(l.cps)
+	l.counter.Reset(c.childCPS())
+
+	c.limiters[l] = struct{}{}
 
 	return l
 }
 
+// register marks the Limiter used, and registers it back in case it was dropped being idle.
+// The Limiters idle for the interval are dropped at most once an interval.
+func (c *Controller) register(l *Limiter, now time.Time) {
+	atomic.StoreInt64(&l.used, now.UnixNano())
+
+	if atomic.LoadInt32(&l.registered) == 0 {
+		c.lock.Lock()
+		if atomic.LoadInt32(&l.registered) == 0 && atomic.LoadInt32(&l.released) == 0 {
+			// the measures are gone while idle, so the Limiter is just moved to the window Reconfigure could change
+			interval, ticks := c.Window()
+			if r, ok := l.counter.(Resizer); ok {
+				r.Resize(interval, ticks)
+			}
+			if s := l.tracked(); s != nil {
+				s.resize(interval, ticks)
+			}
+			l.stats.resize(interval, ticks)
+
+			c.limiters[l] = struct{}{}
+			atomic.StoreInt32(&l.registered, 1)
+		}
+		c.lock.Unlock()
+	}
+
+	c.sweep(now)
+}
+
+// sweep drops the Limiters idle for the interval, but the ones having a rate guaranteed.
+func (c *Controller) sweep(now time.Time) {
+	var (
+		interval = int64(c.intervalDuration())
+		swept    = atomic.LoadInt64(&c.swept)
+	)
+
+	if now.UnixNano()-swept < interval || !atomic.CompareAndSwapInt64(&c.swept, swept, now.UnixNano()) {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for l := range c.limiters {
+		if now.UnixNano()-atomic.LoadInt64(&l.used) >= interval && atomic.LoadInt64(&l.minCPS) <= 0 {
+			delete(c.limiters, l)
+			atomic.StoreInt32(&l.registered, 0)
+		}
+	}
+}
+
+// Limiters returns the Limiters born by the Controller, not released and used for the last interval.
+// Limiters having a rate guaranteed are listed until released.
+// Limiters of the nested Controllers are not included.
+func (c *Controller) Limiters() []*Limiter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	limiters := make([]*Limiter, 0, len(c.limiters))
+	for l := range c.limiters {
+		limiters = append(limiters, l)
+	}
+
+	return limiters
+}
+
+func (c *Controller) release(l *Limiter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.limiters, l)
+	atomic.StoreInt32(&l.registered, 0)
+}
+
+// resetChildren resets the live Limiters of the Controller and all the nested ones.
+func (c *Controller) resetChildren() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for l := range c.limiters {
+		l.reset()
+	}
+
+	for child := range c.children {
+		child.resetChildren()
+	}
+}
+
+// CommonCPS returns the one for all together limit, math.MaxInt64 means unlimited.
+func (c *Controller) CommonCPS() int64 {
+	return atomic.LoadInt64(&c.commonCPS)
+}
+
+// PerChildCPS returns a default limit for the Limiters, math.MaxInt64 means unlimited.
+func (c *Controller) PerChildCPS() int64 {
+	return atomic.LoadInt64(&c.perChildCPS)
+}
+
 // SetCommonCPS sets the one for all together limit
 func (c *Controller) SetCommonCPS(cps int64) {
 	if cps <= 0 {
@@ -78,13 +300,16 @@ func (c *Controller) SetCommonCPS(cps int64) {
 
 	atomic.StoreInt64(&c.commonCPS, cps)
 	c.counter.Reset(cps)
+	c.fair.reset()
 }
 
-// SetPerChildCPS changes a default limit for the new Limiters and also reset the limit on al the existing Limiters.
+// SetPerChildCPS changes a default limit for the new Limiters and also reset the limit on all the live Limiters,
+// including the ones born by the nested Controllers.
 func (c *Controller) SetPerChildCPS(cps int64) {
 	if cps <= 0 {
 		cps = math.MaxInt64
 	}
 
 	atomic.StoreInt64(&c.perChildCPS, cps)
+	c.resetChildren()
 }
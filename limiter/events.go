@@ -0,0 +1,102 @@
+package limiter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventKind is a kind of the Event reported to the hooks.
+type EventKind int
+
+// Event kinds
+const (
+	// EventThrottled is reported when FillUp grants less than requested.
+	EventThrottled EventKind = iota + 1
+	// EventExceeded is reported by readwrite when fragile mode returns ErrExceeded.
+	EventExceeded
+	// EventDeadline is reported by readwrite when ErrDeadline is hit.
+	EventDeadline
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventThrottled:
+		return "throttled"
+	case EventExceeded:
+		return "exceeded"
+	case EventDeadline:
+		return "deadline"
+	}
+
+	return "unknown"
+}
+
+// Event is reported to the hooks.
+type Event struct {
+	Kind EventKind
+	// Limiter the event happened on.
+	Limiter   *Limiter
+	Requested int64
+	Granted   int64
+	// Waited is a time spent waiting before the event, if any.
+	Waited time.Duration
+}
+
+// Hook is a callback the Events are reported to.
+// Hooks are called synchronously, so they are to be fast and not to call the Limiter back.
+type Hook func(e Event)
+
+// hook holds a Hook to be stored in atomic.Value.
+type hook struct {
+	f Hook
+}
+
+// OnEvent sets a hook called on the Limiter events, nil removes it.
+// The hooks of the Controllers up to the root one are called as well.
+func (l *Limiter) OnEvent(h Hook) {
+	l.hook.Store(hook{f: h})
+}
+
+// OnEvent sets a hook called on the events of all the derrived Limiters,
+// including the ones born by the nested Controllers. nil removes it.
+func (c *Controller) OnEvent(h Hook) {
+	c.hook.Store(hook{f: h})
+}
+
+// SetName sets the Limiter name, e.g. to tell the Limiters apart in the hooks.
+// The Limiter stats are summed up by the name in the Controllers from now on, see Controller.NamedStats.
+func (l *Limiter) SetName(name string) {
+	l.name.Store(name)
+}
+
+// Name returns the Limiter name, empty by default.
+func (l *Limiter) Name() string {
+	name, _ := l.name.Load().(string)
+	return name
+}
+
+// Report passes the event to the Limiter hook and the Controllers ones up to the root.
+// The event Limiter is set to l in case it is nil.
+func (l *Limiter) Report(e Event) {
+	if e.Limiter == nil {
+		e.Limiter = l
+	}
+
+	call(&l.hook, e)
+	for c := l.controller; c != nil; c = c.parent {
+		call(&c.hook, e)
+	}
+}
+
+// Report passes the event to all the Limiters.
+func (j *Joint) Report(e Event) {
+	for _, l := range j.limiters {
+		l.Report(e)
+	}
+}
+
+func call(v *atomic.Value, e Event) {
+	if h, ok := v.Load().(hook); ok && h.f != nil {
+		h.f(e)
+	}
+}
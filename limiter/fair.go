@@ -0,0 +1,203 @@
+package limiter
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/onokonem/go-throttledio/internal/conv"
+	"github.com/onokonem/go-throttledio/internal/counter"
+)
+
+// shares holds the Limiter measures the fair share and the floor are using.
+// They are born once needed, so the Limiters of the Controllers not limited by commonCPS stay small.
+type shares struct {
+	demand *counter.Counter // amount allowed by the Limiter own limits
+	usage  *counter.Counter // amount granted
+}
+
+func (s *shares) resize(interval time.Duration, ticks uint) {
+	s.demand.Resize(interval, ticks)
+	s.usage.Resize(interval, ticks)
+}
+
+// shared tells if the Limiter measures are needed: the Controller commonCPS is limited or the Limiter has a floor.
+func (l *Limiter) shared() bool {
+	return atomic.LoadInt64(&l.controller.commonCPS) != math.MaxInt64 || atomic.LoadInt64(&l.minCPS) > 0
+}
+
+// tracked returns the Limiter measures, nil in case they are not born yet.
+func (l *Limiter) tracked() *shares {
+	s, _ := l.shares.Load().(*shares)
+	return s
+}
+
+// track returns the Limiter measures, born in case they are not yet.
+func (l *Limiter) track() *shares {
+	l.sharesOnce.Do(func() {
+		interval, ticks := l.controller.Window()
+		l.shares.Store(&shares{
+			demand: counter.NewCounter(interval, ticks, l.controller.clock),
+			usage:  counter.NewCounter(interval, ticks, l.controller.clock),
+		})
+	})
+
+	return l.tracked()
+}
+
+// fairShare divides commonCPS between the Limiters competing for it in proportion to their weights.
+// Max-min fairness is used: the Limiters demanding less than their share are satisfied,
+// the rest is divided between the others. Nobody is limited while the total demand fits commonCPS.
+// The share is recalculated once a tick.
+type fairShare struct {
+	active  map[*Limiter]struct{}
+	level   uint64 // math.Float64bits of the interval amount per weight unit, +Inf for no limit
+	updated int64  // unix nano time the level was calculated
+	lock    sync.Mutex
+}
+
+func newFairShare() *fairShare {
+	return &fairShare{
+		active: make(map[*Limiter]struct{}),
+		level:  math.Float64bits(math.Inf(1)),
+	}
+}
+
+// join marks the Limiter as a competing one.
+func (f *fairShare) join(l *Limiter) {
+	if !atomic.CompareAndSwapInt32(&l.active, 0, 1) {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.active[l] = struct{}{}
+}
+
+// leave removes the Limiter from the competing ones.
+func (f *fairShare) leave(l *Limiter) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.active, l)
+	atomic.StoreInt32(&l.active, 0)
+}
+
+// reset forgets the usage accounted, to be used with new commonCPS.
+func (f *fairShare) reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for l := range f.active {
+		l.track().usage.Reset(0)
+	}
+
+	atomic.StoreInt64(&f.updated, 0)
+}
+
+// limit returns an amount the Limiter is allowed to get now.
+func (f *fairShare) limit(c *Controller, l *Limiter) int64 {
+	f.join(l)
+
+	var (
+		now             = c.clock.Now().UnixNano()
+		updated         = atomic.LoadInt64(&f.updated)
+		interval, ticks = c.Window()
+	)
+
+	if now-updated >= int64(interval/time.Duration(ticks)) && atomic.CompareAndSwapInt64(&f.updated, updated, now) {
+		atomic.StoreUint64(&f.level, math.Float64bits(f.calculate(c)))
+	}
+
+	level := math.Float64frombits(atomic.LoadUint64(&f.level))
+	if math.IsInf(level, 1) {
+		return math.MaxInt64
+	}
+
+	share := level * float64(atomic.LoadInt64(&l.weight))
+	if share > conv.MaxFloat64Int64 {
+		return math.MaxInt64
+	}
+
+	return int64(share) - l.track().usage.FillUp(0)
+}
+
+// delay returns a time to wait until the share allows the Limiter to get n:
+// until the usage over the share expires, but no longer than the next recalculation.
+func (f *fairShare) delay(c *Controller, l *Limiter, n int64) time.Duration {
+	level := math.Float64frombits(atomic.LoadUint64(&f.level))
+	if math.IsInf(level, 1) || atomic.LoadInt32(&l.active) == 0 {
+		return 0
+	}
+
+	share := level * float64(atomic.LoadInt64(&l.weight))
+	usage := l.track().usage
+
+	if share > conv.MaxFloat64Int64 || int64(share)-usage.FillUp(0) >= n {
+		return 0
+	}
+
+	var (
+		interval, ticks = c.Window()
+		tick            = interval / time.Duration(ticks)
+		recalculation   = time.Duration(atomic.LoadInt64(&f.updated) + int64(tick) - c.clock.Now().UnixNano())
+		d               = usage.Delay(n, int64(share/interval.Seconds()))
+	)
+
+	if recalculation <= 0 {
+		recalculation = tick
+	}
+
+	if d <= 0 || d > recalculation {
+		d = recalculation
+	}
+
+	return d
+}
+
+// calculate returns a new level, the Limiters have not demanded anything for the interval are left.
+func (f *fairShare) calculate(c *Controller) float64 {
+	capacity := float64(atomic.LoadInt64(&c.commonCPS)) * c.intervalDuration().Seconds()
+
+	type demand struct {
+		weight float64
+		amount float64
+	}
+
+	f.lock.Lock()
+
+	demands := make([]demand, 0, len(f.active))
+	for l := range f.active {
+		amount := l.track().demand.FillUp(0)
+		if amount <= 0 {
+			delete(f.active, l)
+			atomic.StoreInt32(&l.active, 0)
+			continue
+		}
+		demands = append(demands, demand{weight: float64(atomic.LoadInt64(&l.weight)), amount: float64(amount)})
+	}
+
+	f.lock.Unlock()
+
+	sort.Slice(demands, func(i, j int) bool {
+		return demands[i].amount/demands[i].weight < demands[j].amount/demands[j].weight
+	})
+
+	weight := float64(0)
+	for _, d := range demands {
+		weight += d.weight
+	}
+
+	for _, d := range demands {
+		if d.amount/d.weight > capacity/weight {
+			return capacity / weight
+		}
+		capacity -= d.amount
+		weight -= d.weight
+	}
+
+	return math.Inf(1)
+}
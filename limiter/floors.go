@@ -0,0 +1,117 @@
+package limiter
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// floors keeps the minimal rates guaranteed to the Controller Limiters.
+// The guaranteed amount not used by a Limiter for the interval is not granted to the others.
+type floors struct {
+	limiters map[*Limiter]struct{}
+	total    int64 // sum of the minimal rates
+	lock     sync.Mutex
+}
+
+func newFloors() *floors {
+	return &floors{
+		limiters: make(map[*Limiter]struct{}),
+	}
+}
+
+// set changes the Limiter minimal rate, ErrOvercommitted is returned in case the sum exceeds commonCPS.
+func (f *floors) set(c *Controller, l *Limiter, cps int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	total := f.total - atomic.LoadInt64(&l.minCPS) + cps
+	if commonCPS := atomic.LoadInt64(&c.commonCPS); total > commonCPS {
+		return fmt.Errorf("guaranteed %d of %d: %w", total, commonCPS, ErrOvercommitted)
+	}
+
+	atomic.StoreInt64(&l.minCPS, cps)
+	atomic.StoreInt64(&f.total, total)
+
+	if cps > 0 {
+		f.limiters[l] = struct{}{}
+	} else {
+		delete(f.limiters, l)
+	}
+
+	return nil
+}
+
+// remove forgets the Limiter minimal rate, so the Limiter is not granted its floor anymore.
+func (f *floors) remove(l *Limiter) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	minCPS := atomic.SwapInt64(&l.minCPS, 0)
+
+	if _, ok := f.limiters[l]; !ok {
+		return
+	}
+
+	delete(f.limiters, l)
+	atomic.AddInt64(&f.total, -minCPS)
+}
+
+// poolCPS returns commonCPS less the amount guaranteed to the other Limiters and not used by them yet.
+func (f *floors) poolCPS(c *Controller, l *Limiter) int64 {
+	commonCPS := atomic.LoadInt64(&c.commonCPS)
+	if commonCPS == math.MaxInt64 || atomic.LoadInt64(&f.total) == 0 {
+		return commonCPS
+	}
+
+	f.lock.Lock()
+	unused := int64(0)
+	for r := range f.limiters {
+		if r != l {
+			unused += r.unusedFloor()
+		}
+	}
+	f.lock.Unlock()
+
+	return commonCPS - int64(float64(unused)/c.intervalDuration().Seconds())
+}
+
+// unusedFloor returns the amount guaranteed to the Limiter and not used for the interval.
+func (l *Limiter) unusedFloor() int64 {
+	minCPS := atomic.LoadInt64(&l.minCPS)
+	if minCPS <= 0 {
+		return 0
+	}
+
+	return maxInt64(int64(float64(minCPS)*l.controller.intervalDuration().Seconds())-l.track().usage.FillUp(0), 0)
+}
+
+// SetMinCPS sets the rate guaranteed to the Limiter within the Controller commonCPS,
+// the Controller reserves it before the rest is shared between the others. Not positive cps removes it.
+// The Limiter own limits and the parent Controllers ones are applied as usual.
+// ErrOvercommitted is returned and nothing is changed in case the rates guaranteed exceed commonCPS.
+// Guarantees are exact with the SlidingWindow algorithm, the others are approximated.
+func (l *Limiter) SetMinCPS(cps int64) error {
+	if cps < 0 {
+		cps = 0
+	}
+
+	if cps > 0 {
+		l.track()
+	}
+
+	return l.controller.floors.set(l.controller, l, cps)
+}
+
+// MinCPS returns the rate guaranteed to the Limiter, 0 for none.
+func (l *Limiter) MinCPS() int64 {
+	return atomic.LoadInt64(&l.minCPS)
+}
+
+// ReservedCPS returns the sum of the rates guaranteed to the Controller Limiters.
+// It could exceed commonCPS in case it was lowered after the guarantees were made,
+// the guarantees are shrunk then, as the Limiters are not granted more than commonCPS anyway.
+func (c *Controller) ReservedCPS() int64 {
+	return atomic.LoadInt64(&c.floors.total)
+}
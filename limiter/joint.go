@@ -0,0 +1,142 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+)
+
+// Throttle is a limiting unit readwrite and netlisten are working with: a Limiter, a Joint or a Composite.
+type Throttle interface {
+	// FillUp reports n, returns an amount granted. Negative n returns the amount back.
+	FillUp(n int64) int64
+	// WaitN blocks until some of n is granted.
+	WaitN(ctx context.Context, n int64) (int64, error)
+	// QuotaLeft returns an amount left until the quota renewal, and the renewal time.
+	QuotaLeft() (int64, time.Time)
+	// Clock returns a time source used.
+	Clock() clock.Clock
+	// Report passes the event to the hooks.
+	Report(e Event)
+}
+
+var (
+	_ Throttle = (*Limiter)(nil)
+	_ Throttle = (*Joint)(nil)
+	_ Throttle = (*Composite)(nil)
+)
+
+// Joint is a set of Limiters applied together, e.g. a per direction one and a budget shared by both directions.
+// An amount is granted in case all the Limiters grant it, partial grants are returned back.
+type Joint struct {
+	limiters []*Limiter
+}
+
+// NewJoint creates a Joint of the Limiters provided, the clock of the first one is used.
+// Panics with ErrInvalidParams in case there are no Limiters.
+func NewJoint(limiters ...*Limiter) *Joint {
+	if len(limiters) == 0 {
+		panic(fmt.Errorf("limiters: %d: %w", len(limiters), ErrInvalidParams))
+	}
+
+	return &Joint{limiters: limiters}
+}
+
+// Limiters returns the Limiters joint.
+func (j *Joint) Limiters() []*Limiter {
+	return j.limiters
+}
+
+// Clock returns a time source of the first Limiter.
+func (j *Joint) Clock() clock.Clock {
+	return j.limiters[0].Clock()
+}
+
+// FillUp checks n against all the Limiters and returns an amount granted by all of them.
+// EventThrottled is reported in case less than n is granted.
+// Not positive n is reported to all the Limiters unconditionally.
+func (j *Joint) FillUp(n int64) int64 {
+	if n <= 0 {
+		for _, l := range j.limiters {
+			l.FillUp(n)
+		}
+		return n
+	}
+
+	allowed := j.grant(n)
+	j.record(n, allowed)
+
+	if allowed < n {
+		j.Report(Event{Kind: EventThrottled, Requested: n, Granted: allowed})
+	}
+
+	return allowed
+}
+
+// grant checks n against all the Limiters, partial grants are returned back to the ones passed already.
+func (j *Joint) grant(n int64) int64 {
+	allowed := n
+	for i, l := range j.limiters {
+		granted := l.grant(allowed)
+		if granted < allowed {
+			for _, r := range j.limiters[:i] {
+				r.add(granted - allowed)
+			}
+			allowed = granted
+		}
+
+		if allowed <= 0 {
+			return 0
+		}
+	}
+
+	return allowed
+}
+
+// WaitN blocks until all the Limiters are able to grant some of n and returns an actual amount granted.
+// Returns ctx.Err() in case ctx is done before anything was granted,
+// and ErrQuotaExhausted in case nothing is left until a quota renewal.
+// Time spent waiting is reported to all the Limiters stats as throttled, and to the hooks with EventThrottled.
+func (j *Joint) WaitN(ctx context.Context, n int64) (int64, error) {
+	return waitN(ctx, j, n)
+}
+
+// record reports a request of n and an amount granted to all the Limiters stats.
+func (j *Joint) record(n, granted int64) {
+	for _, l := range j.limiters {
+		l.record(n, granted)
+	}
+}
+
+// throttle reports a time spent waiting to all the Limiters stats.
+func (j *Joint) throttle(d time.Duration) {
+	for _, l := range j.limiters {
+		l.throttle(d)
+	}
+}
+
+// QuotaLeft returns the least amount left of all the Limiters, and the renewal time.
+func (j *Joint) QuotaLeft() (int64, time.Time) {
+	left, resetAt := j.limiters[0].QuotaLeft()
+	for _, l := range j.limiters[1:] {
+		if ll, lr := l.QuotaLeft(); ll < left {
+			left, resetAt = ll, lr
+		}
+	}
+
+	return left, resetAt
+}
+
+// delay returns a time to wait until all the Limiters are able to grant n.
+func (j *Joint) delay(n int64) time.Duration {
+	d := time.Duration(0)
+	for _, l := range j.limiters {
+		if dl := l.delay(n); dl > d {
+			d = dl
+		}
+	}
+
+	return d
+}
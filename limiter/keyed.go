@@ -0,0 +1,202 @@
+package limiter
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyedController keeps a Limiter per key, e.g. a client IP, an API key or a user.
+// Limiters are born by the Controller lazily, the ones neither used nor looked up for the TTL
+// or the least recently used ones beyond the maximum size are released and forgotten.
+// Eviction is done on the calls, no goroutine is used.
+type KeyedController struct {
+	controller *Controller
+	ttl        time.Duration
+	maxSize    int
+	limiters   map[string]*list.Element
+	lru        *list.List // of *keyedLimiter, the most recently used first
+	lock       sync.Mutex
+}
+
+type keyedLimiter struct {
+	key     string
+	limiter *Limiter
+	used    int64 // unix nano time the Limiter was seen used last, it is moved to the front then
+}
+
+// KeyedOption is a KeyedController option.
+type KeyedOption func(*KeyedController)
+
+// WithTTL sets a time the Limiter is kept after the last use or lookup, not positive means forever.
+func WithTTL(ttl time.Duration) KeyedOption {
+	return func(k *KeyedController) {
+		k.ttl = ttl
+	}
+}
+
+// WithMaxSize sets a maximum number of the Limiters kept, not positive means no limit.
+func WithMaxSize(maxSize int) KeyedOption {
+	return func(k *KeyedController) {
+		k.maxSize = maxSize
+	}
+}
+
+// NewKeyedController creates a KeyedController with the Limiters born by controller.
+// opts are applied in order provided.
+func NewKeyedController(controller *Controller, opts ...KeyedOption) *KeyedController {
+	k := &KeyedController{
+		controller: controller,
+		limiters:   make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+
+	for _, opt := range opts {
+		opt(k)
+	}
+
+	return k
+}
+
+// Controller returns the Controller the Limiters are born by.
+func (k *KeyedController) Controller() *Controller {
+	return k.controller
+}
+
+// Limiter returns the Limiter for the key, a new one is born in case there is none.
+// The Limiter held is kept as long as it is used, so it could be looked up once.
+func (k *KeyedController) Limiter(key string) *Limiter {
+	now := k.controller.clock.Now()
+
+	if l := k.lookup(key, now); l != nil {
+		k.controller.register(l, now)
+		return l
+	}
+
+	// born out of the lock, as the Controller could drop its idle Limiters doing so
+	born := k.controller.BornLimiter()
+
+	k.lock.Lock()
+	l := k.insertLocked(key, born, now)
+	k.lock.Unlock()
+
+	// the one born concurrently is returned
+	if l != born {
+		born.Release()
+		k.controller.register(l, now)
+	}
+
+	return l
+}
+
+// lookup returns the Limiter for the key marked used, if any.
+func (k *KeyedController) lookup(key string, now time.Time) *Limiter {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.evictLocked(now)
+
+	e, ok := k.limiters[key]
+	if !ok {
+		return nil
+	}
+
+	kl := e.Value.(*keyedLimiter)
+	kl.used = now.UnixNano()
+	atomic.StoreInt64(&kl.limiter.used, kl.used)
+	k.lru.MoveToFront(e)
+
+	return kl.limiter
+}
+
+// insertLocked keeps l for the key, unless there is one already, and returns the one kept.
+func (k *KeyedController) insertLocked(key string, l *Limiter, now time.Time) *Limiter {
+	if e, ok := k.limiters[key]; ok {
+		kl := e.Value.(*keyedLimiter)
+		kl.used = now.UnixNano()
+		atomic.StoreInt64(&kl.limiter.used, kl.used)
+		k.lru.MoveToFront(e)
+
+		return kl.limiter
+	}
+
+	k.limiters[key] = k.lru.PushFront(&keyedLimiter{key: key, limiter: l, used: now.UnixNano()})
+
+	if k.maxSize > 0 {
+		for k.lru.Len() > k.maxSize {
+			k.removeLocked(k.lru.Back())
+		}
+	}
+
+	return l
+}
+
+// Remove releases and forgets the Limiter for the key, if any.
+func (k *KeyedController) Remove(key string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if e, ok := k.limiters[key]; ok {
+		k.removeLocked(e)
+	}
+}
+
+// Len returns a number of the Limiters kept, the idle ones are evicted first.
+func (k *KeyedController) Len() int {
+	now := k.controller.clock.Now()
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.evictLocked(now)
+
+	return k.lru.Len()
+}
+
+// Keys returns the keys of the Limiters kept, the most recently used first.
+func (k *KeyedController) Keys() []string {
+	now := k.controller.clock.Now()
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.evictLocked(now)
+
+	keys := make([]string, 0, k.lru.Len())
+	for e := k.lru.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*keyedLimiter).key)
+	}
+
+	return keys
+}
+
+// evictLocked removes the Limiters neither used nor looked up for the TTL, the least recently used are at the back.
+// The ones used since seen last are moved to the front instead.
+func (k *KeyedController) evictLocked(now time.Time) {
+	if k.ttl <= 0 {
+		return
+	}
+
+	for i := k.lru.Len(); i > 0; i-- {
+		e := k.lru.Back()
+		kl := e.Value.(*keyedLimiter)
+
+		used := atomic.LoadInt64(&kl.limiter.used)
+		switch {
+		case now.UnixNano()-used >= int64(k.ttl):
+			k.removeLocked(e)
+		case used > kl.used:
+			kl.used = used
+			k.lru.MoveToFront(e)
+		default:
+			return
+		}
+	}
+}
+
+func (k *KeyedController) removeLocked(e *list.Element) {
+	kl := k.lru.Remove(e).(*keyedLimiter)
+	delete(k.limiters, kl.key)
+	kl.limiter.Release()
+}
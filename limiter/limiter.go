@@ -1,18 +1,38 @@
 package limiter
 
 import (
+	"context"
 	"math"
+	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/onokonem/go-throttledio/internal/counter"
+	"github.com/onokonem/go-throttledio/clock"
 )
 
 // Limiter is an actual limiting unit
 type Limiter struct {
-	controller  *Controller
-	counter     *counter.Counter
-	cps         int64
-	perChildCPS int64
+	controller *Controller
+	counter    Algorithm
+	deferred   deferred
+	shares     atomic.Value // *shares, born once needed
+	sharesOnce sync.Once
+	stats      *stats
+	quota      *quota
+	hook       atomic.Value
+	name       atomic.Value
+	cps        int64
+	minCPS     int64
+	weight     int64
+	used       int64 // unix nano time the Limiter was asked to grant
+	active     int32
+	registered int32
+	released   int32
+}
+
+// Clock returns a time source the Limiter is using.
+func (l *Limiter) Clock() clock.Clock {
+	return l.controller.clock
 }
 
 // SetCPS sets the limit.
@@ -22,42 +42,181 @@ func (l *Limiter) SetCPS(cps int64) {
 	}
 
 	atomic.StoreInt64(&l.cps, cps)
-	l.counter.Reset(minInt64(cps, atomic.LoadInt64(&l.controller.perChildCPS)))
+	l.reset()
+}
+
+// Release unregisters the Limiter from the Controller.
+// Released Limiter is still limited, but is not listed by the Controller and does not get perChildCPS changes anymore.
+// The rate guaranteed by SetMinCPS is not reserved anymore.
+func (l *Limiter) Release() {
+	atomic.StoreInt32(&l.released, 1)
+	l.controller.release(l)
+	l.controller.fair.leave(l)
+	l.controller.floors.remove(l)
+}
+
+// reset the Limiter to be used with the actual limit.
+func (l *Limiter) reset() {
+	l.counter.Reset(minInt64(atomic.LoadInt64(&l.cps), l.controller.childCPS()))
+}
+
+// SetWeight sets the Limiter weight, 1 by default.
+// commonCPS is divided between the competing Limiters in proportion to their weights,
+// still the Limiters are allowed to use any capacity left by the others.
+func (l *Limiter) SetWeight(weight int64) {
+	if weight <= 0 {
+		weight = 1
+	}
+
+	atomic.StoreInt64(&l.weight, weight)
 }
 
 // FillUp is used to report counter to Limiter.
+// The amount is checked against the Limiter and all the Controllers up to the root one,
+// partial grants are returned back to the ones passed already.
+// EventThrottled is reported in case less than n is granted.
 func (l *Limiter) FillUp(n int64) int64 {
 	switch {
 	case n == 0:
 		return n
 	case n < 0:
-		l.counter.FillUp(n)
-		l.controller.counter.FillUp(n)
+		l.fillUp(n)
 		return n
 	}
 
-	perChildCPS := atomic.LoadInt64(&l.controller.perChildCPS)
-	cps := minInt64(atomic.LoadInt64(&l.cps), perChildCPS)
+	allowed := l.grant(n)
+	l.record(n, allowed)
+
+	if allowed < n {
+		l.Report(Event{Kind: EventThrottled, Requested: n, Granted: allowed})
+	}
+
+	return allowed
+}
+
+// grant checks n against the Limiter and all the Controllers, quotas first.
+func (l *Limiter) grant(n int64) int64 {
+	now := l.controller.clock.Now()
+
+	l.controller.register(l, now)
 
-	if l.perChildCPS != perChildCPS {
-		l.perChildCPS = perChildCPS
-		l.counter.Reset(cps)
+	n = l.takeQuota(now, n)
+	if n <= 0 {
+		return 0
 	}
 
-	allowed := l.counter.FillUpToCap(n, cps)
-	allowedCommon := l.controller.counter.FillUpToCap(allowed, atomic.LoadInt64(&l.controller.commonCPS))
+	allowed := l.deferred.fillUpToCap(l.counter, now, l.controller.intervalDuration(), n, minInt64(atomic.LoadInt64(&l.cps), l.controller.childCPS()))
+
+	if allowed > 0 && l.shared() {
+		l.track().demand.FillUp(allowed)
+
+		fair := maxInt64(l.controller.fair.limit(l.controller, l), l.unusedFloor())
+		if fair = maxInt64(fair, 0); fair < allowed {
+			l.counter.FillUp(fair - allowed)
+			allowed = fair
+		}
+	}
 
-	if allowedCommon < allowed {
-		l.counter.FillUp(allowedCommon - allowed)
-		return allowedCommon
+	for c := l.controller; c != nil && allowed > 0; c = c.parent {
+		allowedCommon := c.deferred.fillUpToCap(c.counter, now, c.intervalDuration(), allowed, c.floors.poolCPS(c, l))
+		if allowedCommon < allowed {
+			l.counter.FillUp(allowedCommon - allowed)
+			for r := l.controller; r != c; r = r.parent {
+				r.counter.FillUp(allowedCommon - allowed)
+			}
+			allowed = allowedCommon
+		}
+	}
+
+	if allowed < n {
+		l.fillUpQuota(now, allowed-n)
+	}
+
+	if s := l.tracked(); s != nil {
+		s.usage.FillUp(allowed)
 	}
 
 	return allowed
 }
 
+// fillUp adds n to the Limiter and all the Controllers up to the root one unconditionally.
+func (l *Limiter) fillUp(n int64) {
+	l.account(func(s *stats) { s.grant(n) })
+	l.add(n)
+}
+
+// add is fillUp not reporting the stats, e.g. to return a grant not used.
+func (l *Limiter) add(n int64) {
+	l.fillUpQuota(l.controller.clock.Now(), n)
+	if s := l.tracked(); s != nil {
+		s.usage.FillUp(n)
+	}
+	l.counter.FillUp(n)
+	for c := l.controller; c != nil; c = c.parent {
+		c.counter.FillUp(n)
+	}
+}
+
+// WaitN blocks until the Limiter is able to grant some of n and returns an actual amount granted.
+// Returns ctx.Err() in case ctx is done before anything was granted,
+// and ErrQuotaExhausted in case nothing is left until a quota renewal.
+// Time spent waiting is reported to the Limiter stats as throttled, and to the hooks with EventThrottled.
+func (l *Limiter) WaitN(ctx context.Context, n int64) (int64, error) {
+	return waitN(ctx, l, n)
+}
+
+// record reports a request of n and an amount granted to the Limiter and all the Controllers stats.
+func (l *Limiter) record(n, granted int64) {
+	l.account(func(s *stats) { s.request(n, granted) })
+}
+
+// throttle reports a time spent waiting to the Limiter and all the Controllers stats.
+func (l *Limiter) throttle(d time.Duration) {
+	l.account(func(s *stats) { s.throttle(d) })
+}
+
+// capacity returns a maximum amount the Limiter and all the Controllers are able to grant at once.
+func (l *Limiter) capacity() int64 {
+	capacity := l.counter.Capacity(minInt64(atomic.LoadInt64(&l.cps), l.controller.childCPS()))
+	for c := l.controller; c != nil; c = c.parent {
+		capacity = minInt64(capacity, c.counter.Capacity(atomic.LoadInt64(&c.commonCPS)))
+	}
+
+	return capacity
+}
+
+// delay returns a time to wait until the Limiter, its fair share and all the Controllers are able to grant n,
+// the amounts reserved for later are treated as used.
+func (l *Limiter) delay(n int64) time.Duration {
+	now := l.controller.clock.Now()
+
+	d := l.deferred.delay(l.counter, now, l.controller.intervalDuration(), n, minInt64(atomic.LoadInt64(&l.cps), l.controller.childCPS()))
+	// the floor not used yet is granted regardless of the fair share, the same way grant does
+	if l.unusedFloor() < n {
+		if df := l.controller.fair.delay(l.controller, l, n); df > d {
+			d = df
+		}
+	}
+
+	for c := l.controller; c != nil; c = c.parent {
+		if dc := c.deferred.delay(c.counter, now, c.intervalDuration(), n, c.floors.poolCPS(c, l)); dc > d {
+			d = dc
+		}
+	}
+
+	return d
+}
+
 func minInt64(a, b int64) int64 {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -1,15 +1,20 @@
 package limiter_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"math/rand"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/clock/clocktest"
 	"github.com/onokonem/go-throttledio/limiter"
 )
 
@@ -32,14 +37,28 @@ const (
 
 func init() { rand.Seed(time.Now().UnixNano()) }
 
-func fillUp(l *limiter.Limiter, endTime time.Time, sleep time.Duration, total *int64, wg *sync.WaitGroup) {
-	defer wg.Done()
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) // nolint: gochecknoglobals
 
-	for ; time.Now().Before(endTime); time.Sleep(sleep) {
-		n := rand.Int63n(math.MaxInt64 / 1000000000)
-		a := l.FillUp(n)
-		atomic.AddInt64(total, a)
+// fillUp keeps the limiters filled up for d moving m by a half of the test tick, in a random order every time,
+// and returns the amounts granted to each.
+func fillUp(m *clocktest.Manual, limiters []*limiter.Limiter, d time.Duration) []int64 {
+	totals := make([]int64, len(limiters))
+
+	for endTime := m.Now().Add(d); m.Now().Before(endTime); m.Advance(testDuration / ticks / 2) {
+		for _, i := range rand.Perm(len(limiters)) {
+			totals[i] += limiters[i].FillUp(rand.Int63n(math.MaxInt64 / 1000000000))
+		}
+	}
+
+	return totals
+}
+
+func sum(totals []int64) int64 {
+	total := int64(0)
+	for _, n := range totals {
+		total += n
 	}
+	return total
 }
 
 func calculateResult(startTime, endTime time.Time, total int64, reqCPS float64) (time.Duration, float64, float64) {
@@ -53,58 +72,48 @@ func calculateResult(startTime, endTime time.Time, total int64, reqCPS float64)
 
 func TestUUU(t *testing.T) {
 	var (
-		total     = int64(0)
-		startTime = time.Now()
-		endTime   = time.Now().Add(testDuration)
+		m         = clocktest.NewManual(epoch)
+		startTime = m.Now()
 		limiters  = make([]*limiter.Limiter, concurency)
 		reqCPS    = int64(0)
-		c         = limiter.NewController(interval, ticks, 0, 0)
+		c         = limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m))
 	)
 
-	var wg sync.WaitGroup
-	wg.Add(concurency)
 	for ri := 0; ri < concurency; ri++ {
 		limiters[ri] = c.BornLimiter()
-		go fillUp(limiters[ri], endTime, testDuration/ticks/2, &total, &wg)
 	}
-	wg.Wait()
 
-	spent, actualCPS, deviation := calculateResult(startTime, time.Now(), total, float64(reqCPS))
+	total := sum(fillUp(m, limiters, testDuration))
+
+	spent, actualCPS, deviation := calculateResult(startTime, m.Now(), total, float64(reqCPS))
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", total, spent, reqCPS, concurency, actualCPS, deviation)
 }
 
 func TestUUB(t *testing.T) {
 	var (
-		total     = int64(0)
-		startTime = time.Now()
-		endTime   = time.Now().Add(testDuration)
+		m         = clocktest.NewManual(epoch)
+		startTime = m.Now()
 		limiters  = make([]*limiter.Limiter, concurency)
 		reqCPS    = rand.Int63n(1000) + 1000
-		c         = limiter.NewController(interval, ticks, 0, 0)
+		c         = limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m))
 	)
 
-	var wg sync.WaitGroup
-	wg.Add(concurency)
 	for ri := 0; ri < concurency; ri++ {
 		limiters[ri] = c.BornLimiter()
-		go fillUp(limiters[ri], endTime, testDuration/ticks/2, &total, &wg)
 	}
 
-	time.Sleep(testDuration / 2)
-
-	halfTotal := atomic.LoadInt64(&total)
-	spent, actualCPS, deviation := calculateResult(startTime, time.Now(), halfTotal, 0)
+	halfTotal := sum(fillUp(m, limiters, testDuration/2))
+	spent, actualCPS, deviation := calculateResult(startTime, m.Now(), halfTotal, 0)
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", halfTotal, spent, reqCPS, concurency, actualCPS, deviation)
 
 	for _, l := range limiters {
 		l.SetCPS(reqCPS)
 	}
-	atomic.StoreInt64(&total, 0)
-	startTime = time.Now()
+	startTime = m.Now()
 
-	wg.Wait()
+	total := sum(fillUp(m, limiters, testDuration/2))
 
-	spent, actualCPS, deviation = calculateResult(startTime, time.Now(), total, float64(reqCPS*concurency))
+	spent, actualCPS, deviation = calculateResult(startTime, m.Now(), total, float64(reqCPS*concurency))
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", total, spent, reqCPS, concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
@@ -113,34 +122,27 @@ func TestUUB(t *testing.T) {
 
 func TestUBU1(t *testing.T) {
 	var (
-		total     = int64(0)
-		startTime = time.Now()
-		endTime   = time.Now().Add(testDuration)
+		m         = clocktest.NewManual(epoch)
+		startTime = m.Now()
 		limiters  = make([]*limiter.Limiter, concurency)
 		reqCPS    = rand.Int63n(1000) + 1000
-		c         = limiter.NewController(interval, ticks, 0, 0)
+		c         = limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m))
 	)
 
-	var wg sync.WaitGroup
-	wg.Add(concurency)
 	for ri := 0; ri < concurency; ri++ {
 		limiters[ri] = c.BornLimiter()
-		go fillUp(limiters[ri], endTime, testDuration/ticks/2, &total, &wg)
 	}
 
-	time.Sleep(testDuration / 2)
-
-	halfTotal := atomic.LoadInt64(&total)
-	spent, actualCPS, deviation := calculateResult(startTime, time.Now(), halfTotal, float64(reqCPS*concurency))
+	halfTotal := sum(fillUp(m, limiters, testDuration/2))
+	spent, actualCPS, deviation := calculateResult(startTime, m.Now(), halfTotal, float64(reqCPS*concurency))
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", halfTotal, spent, reqCPS, concurency, actualCPS, deviation)
 
 	c.SetPerChildCPS(reqCPS)
-	atomic.StoreInt64(&total, 0)
-	startTime = time.Now()
+	startTime = m.Now()
 
-	wg.Wait()
+	total := sum(fillUp(m, limiters, testDuration/2))
 
-	spent, actualCPS, deviation = calculateResult(startTime, time.Now(), total, float64(reqCPS*concurency))
+	spent, actualCPS, deviation = calculateResult(startTime, m.Now(), total, float64(reqCPS*concurency))
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", total, spent, reqCPS, concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
@@ -149,39 +151,32 @@ func TestUBU1(t *testing.T) {
 
 func TestUBU2(t *testing.T) {
 	var (
-		total     = int64(0)
-		startTime = time.Now()
-		endTime   = time.Now().Add(testDuration)
+		m         = clocktest.NewManual(epoch)
+		startTime = m.Now()
 		limiters  = make([]*limiter.Limiter, concurency)
 		reqCPS    = rand.Int63n(1000) + 1000
-		c         = limiter.NewController(interval, ticks, 1, reqCPS)
+		c         = limiter.NewController(interval, ticks, 1, reqCPS, limiter.WithClock(m))
 	)
 
 	c.SetCommonCPS(0)
 
-	var wg sync.WaitGroup
-	wg.Add(concurency)
 	for ri := 0; ri < concurency; ri++ {
 		limiters[ri] = c.BornLimiter()
-		go fillUp(limiters[ri], endTime, testDuration/ticks/2, &total, &wg)
 	}
 
-	time.Sleep(testDuration / 2)
-
-	halfTotal := atomic.LoadInt64(&total)
-	spent, actualCPS, deviation := calculateResult(startTime, time.Now(), halfTotal, float64(reqCPS*concurency))
+	halfTotal := sum(fillUp(m, limiters, testDuration/2))
+	spent, actualCPS, deviation := calculateResult(startTime, m.Now(), halfTotal, float64(reqCPS*concurency))
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", halfTotal, spent, reqCPS, concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
 	}
 
 	c.SetPerChildCPS(reqCPS)
-	atomic.StoreInt64(&total, 0)
-	startTime = time.Now()
+	startTime = m.Now()
 
-	wg.Wait()
+	total := sum(fillUp(m, limiters, testDuration/2))
 
-	spent, actualCPS, deviation = calculateResult(startTime, time.Now(), total, float64(reqCPS*concurency))
+	spent, actualCPS, deviation = calculateResult(startTime, m.Now(), total, float64(reqCPS*concurency))
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", total, spent, reqCPS, concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
@@ -190,35 +185,28 @@ func TestUBU2(t *testing.T) {
 
 func TestBUU1(t *testing.T) {
 	var (
-		total     = int64(0)
-		startTime = time.Now()
-		endTime   = time.Now().Add(testDuration)
+		m         = clocktest.NewManual(epoch)
+		startTime = m.Now()
 		limiters  = make([]*limiter.Limiter, concurency)
 		reqCPS    = rand.Int63n(1000) + 1000
-		c         = limiter.NewController(interval, ticks, 0, 0)
+		c         = limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m))
 	)
 
-	var wg sync.WaitGroup
-	wg.Add(concurency)
 	for ri := 0; ri < concurency; ri++ {
 		limiters[ri] = c.BornLimiter()
 		limiters[ri].SetCPS(0)
-		go fillUp(limiters[ri], endTime, testDuration/ticks/2, &total, &wg)
 	}
 
-	time.Sleep(testDuration / 2)
-
-	halfTotal := atomic.LoadInt64(&total)
-	spent, actualCPS, deviation := calculateResult(startTime, time.Now(), halfTotal, float64(0))
+	halfTotal := sum(fillUp(m, limiters, testDuration/2))
+	spent, actualCPS, deviation := calculateResult(startTime, m.Now(), halfTotal, float64(0))
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", halfTotal, spent, reqCPS, concurency, actualCPS, deviation)
 
 	c.SetCommonCPS(reqCPS)
-	atomic.StoreInt64(&total, 0)
-	startTime = time.Now()
+	startTime = m.Now()
 
-	wg.Wait()
+	total := sum(fillUp(m, limiters, testDuration/2))
 
-	spent, actualCPS, deviation = calculateResult(startTime, time.Now(), total, float64(reqCPS))
+	spent, actualCPS, deviation = calculateResult(startTime, m.Now(), total, float64(reqCPS))
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", total, spent, reqCPS, concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
@@ -227,39 +215,32 @@ func TestBUU1(t *testing.T) {
 
 func TestBUU2(t *testing.T) {
 	var (
-		total     = int64(0)
-		startTime = time.Now()
-		endTime   = time.Now().Add(testDuration)
+		m         = clocktest.NewManual(epoch)
+		startTime = m.Now()
 		limiters  = make([]*limiter.Limiter, concurency)
 		reqCPS    = rand.Int63n(1000) + 1000
-		c         = limiter.NewController(interval, ticks, reqCPS, 1)
+		c         = limiter.NewController(interval, ticks, reqCPS, 1, limiter.WithClock(m))
 	)
 
 	c.SetPerChildCPS(0)
 
-	var wg sync.WaitGroup
-	wg.Add(concurency)
 	for ri := 0; ri < concurency; ri++ {
 		limiters[ri] = c.BornLimiter()
-		go fillUp(limiters[ri], endTime, testDuration/ticks/2, &total, &wg)
 	}
 
-	time.Sleep(testDuration / 2)
-
-	halfTotal := atomic.LoadInt64(&total)
-	spent, actualCPS, deviation := calculateResult(startTime, time.Now(), halfTotal, float64(reqCPS))
+	halfTotal := sum(fillUp(m, limiters, testDuration/2))
+	spent, actualCPS, deviation := calculateResult(startTime, m.Now(), halfTotal, float64(reqCPS))
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", halfTotal, spent, reqCPS, concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
 	}
 
 	c.SetCommonCPS(reqCPS)
-	atomic.StoreInt64(&total, 0)
-	startTime = time.Now()
+	startTime = m.Now()
 
-	wg.Wait()
+	total := sum(fillUp(m, limiters, testDuration/2))
 
-	spent, actualCPS, deviation = calculateResult(startTime, time.Now(), total, float64(reqCPS))
+	spent, actualCPS, deviation = calculateResult(startTime, m.Now(), total, float64(reqCPS))
 	fmt.Printf("counted: %d, spent: %s, cps: %dx%d, actual: %3.3f, deviation: %3.3f\n", total, spent, reqCPS, concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
@@ -268,29 +249,25 @@ func TestBUU2(t *testing.T) {
 
 func TestSMB(t *testing.T) {
 	var (
-		total     = int64(0)
-		startTime = time.Now()
-		endTime   = time.Now().Add(testDuration)
+		m         = clocktest.NewManual(epoch)
+		startTime = m.Now()
 		limiters  = make([]*limiter.Limiter, concurency)
 		reqCPSs   = limit{name: "common", concurency: 1, cps: rand.Int63n(1000) + 1000}
 		reqCPSm   = limit{name: "perChild", concurency: concurency, cps: reqCPSs.cps * (rand.Int63n(20) + 2)}
 		reqCPSb   = limit{name: "limiter", concurency: concurency, cps: reqCPSm.cps * (rand.Int63n(20) + 2)}
 	)
-	c := limiter.NewController(interval, ticks, reqCPSs.cps, reqCPSm.cps)
+	c := limiter.NewController(interval, ticks, reqCPSs.cps, reqCPSm.cps, limiter.WithClock(m))
 
-	var wg sync.WaitGroup
-	wg.Add(concurency)
 	for ri := 0; ri < concurency; ri++ {
 		limiters[ri] = c.BornLimiter()
 		limiters[ri].SetCPS(reqCPSb.cps)
-		go fillUp(limiters[ri], endTime, testDuration/ticks/2, &total, &wg)
 	}
 
-	wg.Wait()
+	total := sum(fillUp(m, limiters, testDuration))
 
 	reqCPS, lim := minLimit(reqCPSs, reqCPSm, reqCPSb)
 
-	spent, actualCPS, deviation := calculateResult(startTime, time.Now(), total, float64(reqCPS))
+	spent, actualCPS, deviation := calculateResult(startTime, m.Now(), total, float64(reqCPS))
 	fmt.Printf("counted: %d, spent: %s, cps %s: %dx%d, actual: %3.3f, deviation: %3.3f\n", total, spent, lim.name, lim.cps, lim.concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
@@ -299,29 +276,25 @@ func TestSMB(t *testing.T) {
 
 func TestBMS(t *testing.T) {
 	var (
-		total     = int64(0)
-		startTime = time.Now()
-		endTime   = time.Now().Add(testDuration)
+		m         = clocktest.NewManual(epoch)
+		startTime = m.Now()
 		limiters  = make([]*limiter.Limiter, concurency)
 		reqCPSs   = limit{name: "limiter", concurency: concurency, cps: rand.Int63n(1000) + 1000}
 		reqCPSm   = limit{name: "perChild", concurency: concurency, cps: reqCPSs.cps * (rand.Int63n(20) + 2)}
 		reqCPSb   = limit{name: "common", concurency: 1, cps: reqCPSm.cps * (rand.Int63n(20) + 2)}
 	)
-	c := limiter.NewController(interval, ticks, reqCPSb.cps, reqCPSm.cps)
+	c := limiter.NewController(interval, ticks, reqCPSb.cps, reqCPSm.cps, limiter.WithClock(m))
 
-	var wg sync.WaitGroup
-	wg.Add(concurency)
 	for ri := 0; ri < concurency; ri++ {
 		limiters[ri] = c.BornLimiter()
 		limiters[ri].SetCPS(reqCPSs.cps)
-		go fillUp(limiters[ri], endTime, testDuration/ticks/2, &total, &wg)
 	}
 
-	wg.Wait()
+	total := sum(fillUp(m, limiters, testDuration))
 
 	reqCPS, lim := minLimit(reqCPSs, reqCPSm, reqCPSb)
 
-	spent, actualCPS, deviation := calculateResult(startTime, time.Now(), total, float64(reqCPS))
+	spent, actualCPS, deviation := calculateResult(startTime, m.Now(), total, float64(reqCPS))
 	fmt.Printf("counted: %d, spent: %s, cps %s: %dx%d, actual: %3.3f, deviation: %3.3f\n", total, spent, lim.name, lim.cps, lim.concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
@@ -330,29 +303,25 @@ func TestBMS(t *testing.T) {
 
 func TestBSM(t *testing.T) {
 	var (
-		total     = int64(0)
-		startTime = time.Now()
-		endTime   = time.Now().Add(testDuration)
+		m         = clocktest.NewManual(epoch)
+		startTime = m.Now()
 		limiters  = make([]*limiter.Limiter, concurency)
 		reqCPSs   = limit{name: "perChild", concurency: concurency, cps: rand.Int63n(1000) + 1000}
 		reqCPSm   = limit{name: "limiter", concurency: concurency, cps: reqCPSs.cps * (rand.Int63n(20) + 2)}
 		reqCPSb   = limit{name: "common", concurency: 1, cps: reqCPSm.cps * (rand.Int63n(20) + 2)}
 	)
-	c := limiter.NewController(interval, ticks, reqCPSb.cps, reqCPSs.cps)
+	c := limiter.NewController(interval, ticks, reqCPSb.cps, reqCPSs.cps, limiter.WithClock(m))
 
-	var wg sync.WaitGroup
-	wg.Add(concurency)
 	for ri := 0; ri < concurency; ri++ {
 		limiters[ri] = c.BornLimiter()
 		limiters[ri].SetCPS(reqCPSm.cps)
-		go fillUp(limiters[ri], endTime, testDuration/ticks/2, &total, &wg)
 	}
 
-	wg.Wait()
+	total := sum(fillUp(m, limiters, testDuration))
 
 	reqCPS, lim := minLimit(reqCPSs, reqCPSm, reqCPSb)
 
-	spent, actualCPS, deviation := calculateResult(startTime, time.Now(), total, float64(reqCPS))
+	spent, actualCPS, deviation := calculateResult(startTime, m.Now(), total, float64(reqCPS))
 	fmt.Printf("counted: %d, spent: %s, cps %s: %dx%d, actual: %3.3f, deviation: %3.3f\n", total, spent, lim.name, lim.cps, lim.concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
@@ -361,29 +330,25 @@ func TestBSM(t *testing.T) {
 
 func TestMBS(t *testing.T) {
 	var (
-		total     = int64(0)
-		startTime = time.Now()
-		endTime   = time.Now().Add(testDuration)
+		m         = clocktest.NewManual(epoch)
+		startTime = m.Now()
 		limiters  = make([]*limiter.Limiter, concurency)
 		reqCPSs   = limit{name: "limiter", concurency: concurency, cps: rand.Int63n(1000) + 1000}
 		reqCPSm   = limit{name: "common", concurency: 1, cps: reqCPSs.cps * (rand.Int63n(20) + 2)}
 		reqCPSb   = limit{name: "perChild", concurency: concurency, cps: reqCPSm.cps * (rand.Int63n(20) + 2)}
 	)
-	c := limiter.NewController(interval, ticks, reqCPSm.cps, reqCPSb.cps)
+	c := limiter.NewController(interval, ticks, reqCPSm.cps, reqCPSb.cps, limiter.WithClock(m))
 
-	var wg sync.WaitGroup
-	wg.Add(concurency)
 	for ri := 0; ri < concurency; ri++ {
 		limiters[ri] = c.BornLimiter()
 		limiters[ri].SetCPS(reqCPSs.cps)
-		go fillUp(limiters[ri], endTime, testDuration/ticks/2, &total, &wg)
 	}
 
-	wg.Wait()
+	total := sum(fillUp(m, limiters, testDuration))
 
 	reqCPS, lim := minLimit(reqCPSs, reqCPSm, reqCPSb)
 
-	spent, actualCPS, deviation := calculateResult(startTime, time.Now(), total, float64(reqCPS))
+	spent, actualCPS, deviation := calculateResult(startTime, m.Now(), total, float64(reqCPS))
 	fmt.Printf("counted: %d, spent: %s, cps %s: %dx%d, actual: %3.3f, deviation: %3.3f\n", total, spent, lim.name, lim.cps, lim.concurency, actualCPS, deviation)
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation)
@@ -438,6 +403,71 @@ func TestReturnCount(t *testing.T) {
 	}
 }
 
+func TestWaitN(t *testing.T) {
+	m := clocktest.NewManual(epoch)
+	l := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m)).BornLimiter()
+
+	// only the current tick is free after the reset
+	expected := int64(100 * interval.Seconds() / ticks)
+	a, err := l.WaitN(context.Background(), 1000)
+	if err != nil || a != expected {
+		t.Errorf("expected (%d, nil), got (%d, %v)", expected, a, err)
+	}
+
+	startTime := m.Now()
+
+	done := make(chan int64)
+	go func() {
+		a, err := l.WaitN(context.Background(), 1000)
+		if err != nil {
+			t.Errorf("expected nil, got %v", err)
+		}
+		done <- a
+	}()
+
+	if a := wait(t, m, done); a <= 0 {
+		t.Errorf("expected >0, got %d", a)
+	}
+
+	// the next tick is free
+	if spent := m.Now().Sub(startTime); spent != interval/ticks {
+		t.Errorf("expected %v, got %v", interval/ticks, spent)
+	}
+}
+
+func TestWaitNCancel(t *testing.T) {
+	m := clocktest.NewManual(epoch)
+	l := limiter.NewController(interval, ticks, 1, 0, limiter.WithClock(m)).BornLimiter()
+	l.FillUp(int64(interval.Seconds()))
+
+	timeout := interval / 30
+	ctx, cancel := clock.WithDeadline(context.Background(), m, m.Now().Add(timeout))
+	defer cancel()
+
+	startTime := m.Now()
+
+	done := make(chan int64)
+	go func() {
+		a, err := l.WaitN(ctx, 1)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+		done <- a
+	}()
+
+	// the deadline and the WaitN Timers, the deadline is the nearest one
+	m.BlockUntil(2)
+	m.Advance(timeout)
+
+	if a := <-done; a != 0 {
+		t.Errorf("expected 0, got %d", a)
+	}
+
+	if spent := m.Now().Sub(startTime); spent != timeout {
+		t.Errorf("expected %v, got %v", timeout, spent)
+	}
+}
+
 type limit struct {
 	name       string
 	cps        int64
@@ -466,3 +496,1165 @@ func testPanic(f func()) (e interface{}) {
 	f()
 	return nil
 }
+
+func TestReserve(t *testing.T) {
+	m := clocktest.NewManual(epoch)
+	l := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m)).BornLimiter()
+
+	if r := l.Reserve(1000); r.OK() {
+		t.Errorf("expected not OK, got %v", r.Delay())
+	}
+
+	n := int64(100 * interval.Seconds() / ticks)
+
+	r1 := l.Reserve(n)
+	if !r1.OK() || r1.Delay() != 0 {
+		t.Errorf("expected (true, 0), got (%v, %v)", r1.OK(), r1.Delay())
+	}
+
+	r2 := l.Reserve(n)
+	if d := r2.Delay(); !r2.OK() || d <= 0 || d > interval/ticks {
+		t.Errorf("expected (true, (0, %v]), got (%v, %v)", interval/ticks, r2.OK(), d)
+	}
+
+	r1.Cancel()
+	r2.Cancel()
+	r2.Cancel()
+
+	r3 := l.Reserve(n)
+	if !r3.OK() || r3.Delay() != 0 {
+		t.Errorf("expected (true, 0), got (%v, %v)", r3.OK(), r3.Delay())
+	}
+
+	r4 := l.Reserve(n)
+	m.Advance(r4.Delay() + interval/ticks)
+	granted := l.Stats().Granted
+
+	// r4 is used already, nothing is returned
+	r4.Cancel()
+
+	if actual := l.Stats().Granted; actual != granted {
+		t.Errorf("expected %d, got %d", granted, actual)
+	}
+}
+
+func TestReserveRate(t *testing.T) {
+	for _, cost := range []int64{1, 5, 20} {
+		var (
+			m       = clocktest.NewManual(epoch)
+			cps     = int64(100)
+			l       = limiter.NewController(interval, ticks, cps, 0, limiter.WithClock(m)).BornLimiter()
+			used    []time.Time
+			max     = cps * int64(interval/time.Second)
+			endTime = m.Now().Add(interval * 10)
+		)
+
+		// let the measures made on Reset go
+		m.Advance(interval)
+		startTime := m.Now()
+
+		for m.Now().Before(endTime) {
+			r := l.Reserve(cost)
+			if !r.OK() {
+				t.Fatalf("%d: expected OK", cost)
+			}
+			m.Advance(r.Delay())
+			used = append(used, m.Now())
+		}
+
+		// no window of the interval long ever gets more than allowed
+		for i, from := 0, 0; i < len(used); i++ {
+			for !used[from].After(used[i].Add(-interval)) {
+				from++
+			}
+			if total := int64(i-from+1) * cost; total > max {
+				t.Fatalf("%d: expected no more than %d for the interval, got %d at %v", cost, max, total, used[i].Sub(startTime))
+			}
+		}
+
+		_, actualCPS, deviation := calculateResult(startTime, m.Now(), int64(len(used))*cost, float64(cps))
+		fmt.Printf("cost: %d, used: %d, actual: %3.3f, deviation: %3.3f\n", cost, len(used), actualCPS, deviation)
+		if math.Abs(deviation) > maxDeviation {
+			t.Errorf("%d: deviation is too big: %3.3f > %3.3f", cost, deviation, maxDeviation)
+		}
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	for name, newAlgorithm := range map[string]limiter.NewAlgorithm{
+		"SlidingWindow": limiter.SlidingWindow,
+		"TokenBucket":   limiter.TokenBucket(100),
+		"GCRA":          limiter.GCRA(100),
+	} {
+		var (
+			m         = clocktest.NewManual(epoch)
+			reqCPS    = rand.Int63n(1000) + 1000
+			l         = limiter.NewController(interval, ticks, reqCPS, 0, limiter.WithClock(m), limiter.WithAlgorithm(newAlgorithm)).BornLimiter()
+			startTime = m.Now()
+			endTime   = startTime.Add(interval)
+			done      = make(chan int64)
+		)
+
+		go func() {
+			total := int64(0)
+			for m.Now().Before(endTime) {
+				a, err := l.WaitN(context.Background(), 10)
+				if err != nil {
+					t.Error(err)
+					break
+				}
+				total += a
+			}
+			done <- total
+		}()
+
+		total := wait(t, m, done)
+
+		spent, actualCPS, deviation := calculateResult(startTime, m.Now(), total, float64(reqCPS))
+		fmt.Printf("%s: counted: %d, spent: %s, cps: %d, actual: %3.3f, deviation: %3.3f\n", name, total, spent, reqCPS, actualCPS, deviation)
+		if math.Abs(deviation) > maxDeviation {
+			t.Errorf("%s: deviation is too big: %3.3f > %3.3f", name, deviation, maxDeviation)
+		}
+	}
+}
+
+func TestBornLimiterAllocs(t *testing.T) {
+	allocs := func(commonCPS int64) float64 {
+		c := limiter.NewController(interval, ticks, commonCPS, 0)
+		return testing.AllocsPerRun(100, func() {
+			c.BornLimiter().FillUp(1)
+		})
+	}
+
+	// the fair share measures are not born while commonCPS is not limited
+	if unlimited, limited := allocs(0), allocs(1000); limited-unlimited < 3 {
+		t.Errorf("expected fewer allocations unlimited, got %v of %v", unlimited, limited)
+	}
+}
+
+func TestBornController(t *testing.T) {
+	root := limiter.NewController(interval, ticks, 10, 0)
+	child := root.BornController(1, 0)
+
+	if child.Parent() != root {
+		t.Errorf("expected %p, got %p", root, child.Parent())
+	}
+
+	l1 := child.BornLimiter()
+	l2 := root.BornLimiter()
+
+	expected := int64(interval.Seconds())
+	if a := l1.FillUp(100); a != expected {
+		t.Errorf("expected %d, got %d", expected, a)
+	}
+
+	expected = int64(interval.Seconds()) * 9
+	if a := l2.FillUp(100); a != expected {
+		t.Errorf("expected %d, got %d", expected, a)
+	}
+
+	l1.FillUp(-int64(interval.Seconds()))
+
+	expected = int64(interval.Seconds())
+	if a := l2.FillUp(100); a != expected {
+		t.Errorf("expected %d, got %d", expected, a)
+	}
+}
+
+func TestBornControllerRefund(t *testing.T) {
+	root := limiter.NewController(interval, ticks, 1, 0)
+	child := root.BornController(5, 0)
+	l := child.BornLimiter()
+
+	expected := int64(interval.Seconds())
+	if a := l.FillUp(10); a != expected {
+		t.Errorf("expected %d, got %d", expected, a)
+	}
+
+	root.SetCommonCPS(0)
+
+	expected = int64(interval.Seconds()) * 4
+	if a := l.FillUp(100); a != expected {
+		t.Errorf("expected %d, got %d", expected, a)
+	}
+}
+
+func TestBornControllerPerChild(t *testing.T) {
+	l := limiter.NewController(interval, ticks, 0, 2).BornController(0, 0).BornLimiter()
+
+	expected := int64(interval.Seconds()) * 2
+	if a := l.FillUp(100); a != expected {
+		t.Errorf("expected %d, got %d", expected, a)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	var (
+		m        = clocktest.NewManual(epoch)
+		reqCPS   = rand.Int63n(1000) + 1000
+		c        = limiter.NewController(interval, ticks, reqCPS, 0, limiter.WithClock(m))
+		limiters = []*limiter.Limiter{c.BornLimiter(), c.BornLimiter()}
+	)
+
+	limiters[1].SetWeight(3)
+
+	totals := fillUp(m, limiters, interval*3) // the share is kept for the whole intervals
+
+	ratio := float64(totals[1]) / float64(totals[0])
+	deviation := (ratio - 3) / 3
+	fmt.Printf("counted: %v, cps: %d, ratio: %3.3f, deviation: %3.3f\n", totals, reqCPS, ratio, deviation)
+	if math.Abs(deviation) > maxDeviation*2 {
+		t.Errorf("deviation is too big: %3.3f > %3.3f", deviation, maxDeviation*2)
+	}
+}
+
+func TestLimiters(t *testing.T) {
+	root := limiter.NewController(interval, ticks, 0, 0)
+	child := root.BornController(0, 0)
+
+	l1 := root.BornLimiter()
+	l2 := root.BornLimiter()
+	l3 := child.BornLimiter()
+
+	if n := len(root.Limiters()); n != 2 {
+		t.Errorf("expected 2, got %d", n)
+	}
+
+	l1.Release()
+	l1.Release()
+
+	if ll := root.Limiters(); len(ll) != 1 || ll[0] != l2 {
+		t.Errorf("expected [%p], got %v", l2, ll)
+	}
+
+	expected := int64(100)
+	if a := l3.FillUp(100); a != expected {
+		t.Errorf("expected %d, got %d", expected, a)
+	}
+
+	root.SetPerChildCPS(1)
+
+	expected = int64(interval.Seconds())
+	for _, l := range []*limiter.Limiter{l2, l3} {
+		if a := l.FillUp(100); a != expected {
+			t.Errorf("expected %d, got %d", expected, a)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	m := clocktest.NewManual(epoch)
+	c := limiter.NewController(interval, ticks, 1, 0, limiter.WithClock(m))
+	l := c.BornLimiter()
+
+	l.FillUp(10)
+	l.FillUp(10)
+	l.FillUp(-1)
+	l.WaitN(context.Background(), 10)
+
+	timeout := interval / 30
+	ctx, cancel := clock.WithDeadline(context.Background(), m, m.Now().Add(timeout))
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		l.WaitN(ctx, 10)
+		close(done)
+	}()
+
+	m.BlockUntil(2)
+	m.Advance(timeout)
+	<-done
+
+	for _, s := range []limiter.Stats{l.Stats(), c.Stats()} {
+		expected := limiter.Stats{
+			Granted:   int64(interval.Seconds()),
+			Requested: 40,
+			Denials:   2,
+			Throttled: timeout,
+			Rate:      1,
+		}
+		if s != expected {
+			t.Errorf("expected %+v, got %+v", expected, s)
+		}
+	}
+}
+
+func TestWaitNManualClock(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m)).BornLimiter()
+
+	// a fresh Limiter is allowed a single tick worth
+	if granted := l.FillUp(1000); granted != 3 {
+		t.Errorf("expected 3, got %d", granted)
+	}
+
+	done := make(chan int64)
+	go func() {
+		granted, err := l.WaitN(context.Background(), 10)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		done <- granted
+	}()
+
+	m.BlockUntil(1)
+	m.Advance(interval)
+
+	if granted := <-done; granted != 10 {
+		t.Errorf("expected 10, got %d", granted)
+	}
+
+	if actual := l.Stats().Throttled; actual != interval {
+		t.Errorf("expected %v, got %v", interval, actual)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	zone := time.FixedZone("UTC+3", 3*60*60)
+
+	// Monday, 08:00 in the zone
+	m := clocktest.NewManual(time.Date(2020, 1, 6, 8, 0, 0, 0, zone))
+	c := limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m))
+	l := c.BornLimiter()
+
+	err := c.SetSchedule(&limiter.Schedule{
+		Location: zone,
+		Windows: []limiter.Window{
+			{
+				Weekdays:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+				Start:     time.Hour * 9,
+				End:       time.Hour * 18,
+				CommonCPS: 100,
+			},
+			{
+				Start:       time.Hour * 22,
+				End:         time.Hour * 6,
+				PerChildCPS: 10000,
+			},
+		},
+		CommonCPS: 1000,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for i, step := range []struct {
+		advance     time.Duration
+		commonCPS   int64
+		perChildCPS int64
+	}{
+		{0, 1000, math.MaxInt64},
+		{time.Hour, 100, math.MaxInt64},           // Monday 09:00
+		{time.Hour * 9, 1000, math.MaxInt64},      // Monday 18:00
+		{time.Hour * 4, math.MaxInt64, 10000},     // Monday 22:00
+		{time.Hour * 8, 1000, math.MaxInt64},      // Tuesday 06:00
+		{time.Hour * 3, 100, math.MaxInt64},       // Tuesday 09:00
+		{time.Hour * 24 * 4, 1000, math.MaxInt64}, // Saturday 09:00
+	} {
+		m.BlockUntil(1)
+		m.Advance(step.advance)
+		m.BlockUntil(1)
+
+		if actual := c.CommonCPS(); actual != step.commonCPS {
+			t.Errorf("%d: expected %d, got %d", i, step.commonCPS, actual)
+		}
+
+		if actual := c.PerChildCPS(); actual != step.perChildCPS {
+			t.Errorf("%d: expected %d, got %d", i, step.perChildCPS, actual)
+		}
+	}
+
+	// Monday 09:00, the new limit is in effect right from the transition, with no burst
+	m.Advance(time.Hour * 48)
+	m.BlockUntil(1)
+
+	if granted := l.FillUp(1000); granted != 3 {
+		t.Errorf("expected 3, got %d", granted)
+	}
+
+	if err := c.SetSchedule(nil); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	m.Advance(time.Hour * 9)
+	if actual := c.CommonCPS(); actual != 100 {
+		t.Errorf("expected 100, got %d", actual)
+	}
+
+	err = c.SetSchedule(&limiter.Schedule{Windows: []limiter.Window{{Start: time.Hour * 24}}})
+	if !errors.Is(err, limiter.ErrInvalidParams) {
+		t.Errorf("expected %v, got %v", limiter.ErrInvalidParams, err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC))
+	c := limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m))
+	l1 := c.BornLimiter()
+	l2 := c.BornLimiter()
+
+	l1.SetQuota(limiter.Quota{Amount: 1000, Period: limiter.PeriodDay, Location: time.UTC})
+	c.SetQuota(limiter.Quota{Amount: 1500, Period: limiter.PeriodMonth, Location: time.UTC})
+
+	for i, step := range []struct {
+		l        *limiter.Limiter
+		n        int64
+		expected int64
+	}{
+		{l1, 600, 600},
+		{l1, 600, 400},
+		{l1, 1, 0},
+		{l1, -100, -100},
+		{l1, 200, 100},
+		{l2, 1000, 500},
+		{l2, 1, 0},
+	} {
+		if actual := step.l.FillUp(step.n); actual != step.expected {
+			t.Errorf("%d: expected %d, got %d", i, step.expected, actual)
+		}
+	}
+
+	left, resetAt := l1.QuotaLeft()
+	if expected := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC); left != 0 || !resetAt.Equal(expected) {
+		t.Errorf("expected (0, %v), got (%d, %v)", expected, left, resetAt)
+	}
+
+	if _, err := l2.WaitN(context.Background(), 1); !errors.Is(err, limiter.ErrQuotaExhausted) {
+		t.Errorf("expected %v, got %v", limiter.ErrQuotaExhausted, err)
+	}
+
+	if r := l2.Reserve(1); r.OK() {
+		t.Errorf("expected the reservation not OK")
+	}
+
+	// both the day and the month are over
+	m.Advance(time.Hour * 12)
+
+	if actual := l1.FillUp(2000); actual != 1000 {
+		t.Errorf("expected 1000, got %d", actual)
+	}
+
+	left, resetAt = c.QuotaLeft()
+	if expected := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC); left != 500 || !resetAt.Equal(expected) {
+		t.Errorf("expected (500, %v), got (%d, %v)", expected, left, resetAt)
+	}
+
+	c.SetQuota(limiter.Quota{})
+
+	if left, _ := c.QuotaLeft(); left != math.MaxInt64 {
+		t.Errorf("expected %d, got %d", int64(math.MaxInt64), left)
+	}
+}
+
+func TestState(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	quota := limiter.Quota{Amount: 1000, Period: limiter.PeriodDay, Location: time.UTC}
+
+	c := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m))
+	l := c.BornLimiter()
+	l.SetQuota(quota)
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	if actual := l.FillUp(1000); actual != 300 {
+		t.Errorf("expected 300, got %d", actual)
+	}
+
+	var states [2]limiter.State
+	for i, s := range []interface{ State() (limiter.State, error) }{c, l} {
+		state, err := s.State()
+		if err != nil {
+			t.Fatalf("%d: expected no error, got %v", i, err)
+		}
+
+		b, err := json.Marshal(state)
+		if err != nil {
+			t.Fatalf("%d: expected no error, got %v", i, err)
+		}
+
+		if err := json.Unmarshal(b, &states[i]); err != nil {
+			t.Fatalf("%d: expected no error, got %v", i, err)
+		}
+	}
+
+	m.Advance(time.Second)
+
+	restoredC := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m))
+	restoredL := restoredC.BornLimiter()
+	restoredL.SetQuota(quota)
+
+	if err := restoredC.Restore(states[0]); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	if err := restoredL.Restore(states[1]); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	// the interval is not over yet, so nothing is granted
+	if actual := restoredL.FillUp(1000); actual != 0 {
+		t.Errorf("expected 0, got %d", actual)
+	}
+
+	m.Advance(interval)
+
+	if actual := restoredL.FillUp(1000); actual != 300 {
+		t.Errorf("expected 300, got %d", actual)
+	}
+
+	if left, _ := restoredL.QuotaLeft(); left != 400 {
+		t.Errorf("expected 400, got %d", left)
+	}
+
+	gcra := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m), limiter.WithAlgorithm(limiter.GCRA(0)))
+	if err := gcra.Restore(states[0]); !errors.Is(err, limiter.ErrInvalidParams) {
+		t.Errorf("expected %v, got %v", limiter.ErrInvalidParams, err)
+	}
+}
+
+func TestKeyedController(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m))
+	k := limiter.NewKeyedController(c, limiter.WithTTL(time.Minute), limiter.WithMaxSize(3))
+
+	a := k.Limiter("a")
+	if k.Limiter("a") != a {
+		t.Errorf("expected the same Limiter")
+	}
+
+	k.Limiter("b")
+	m.Advance(time.Second * 30)
+	k.Limiter("c")
+	k.Limiter("a")
+	k.Limiter("d")
+
+	// b is the least recently used one
+	if actual, expected := fmt.Sprint(k.Keys()), "[d a c]"; actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+
+	if n := len(c.Limiters()); n != 3 {
+		t.Errorf("expected 3, got %d", n)
+	}
+
+	m.Advance(time.Second * 30)
+
+	if actual, expected := fmt.Sprint(k.Keys()), "[d a c]"; actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+
+	m.Advance(time.Second * 30)
+	k.Limiter("d")
+
+	// all are idle for the TTL, so d is a new one
+	if actual, expected := fmt.Sprint(k.Keys()), "[d]"; actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+
+	if k.Limiter("a") == a {
+		t.Errorf("expected a new Limiter")
+	}
+
+	k.Remove("a")
+	k.Remove("a")
+
+	if n := k.Len(); n != 1 {
+		t.Errorf("expected 1, got %d", n)
+	}
+
+	if n := len(c.Limiters()); n != 1 {
+		t.Errorf("expected 1, got %d", n)
+	}
+}
+
+func TestKeyedControllerHeld(t *testing.T) {
+	m := clocktest.NewManual(epoch)
+	c := limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m))
+	k := limiter.NewKeyedController(c, limiter.WithTTL(time.Minute))
+
+	held := k.Limiter("a")
+	k.Limiter("b")
+
+	// a is used, but not looked up, for more than the TTL
+	for i := 0; i < 3; i++ {
+		m.Advance(time.Second * 30)
+		held.FillUp(1)
+	}
+
+	if k.Limiter("a") != held {
+		t.Errorf("expected the Limiter held")
+	}
+
+	if actual, expected := fmt.Sprint(k.Keys()), "[a]"; actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
+
+func TestKeyedControllerConcurrent(t *testing.T) {
+	c := limiter.NewController(interval, ticks, 0, 0)
+	k := limiter.NewKeyedController(c, limiter.WithTTL(time.Millisecond), limiter.WithMaxSize(10))
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				k.Limiter(fmt.Sprint(rand.Intn(20))).FillUp(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := k.Len(); n > 10 {
+		t.Errorf("expected no more than 10, got %d", n)
+	}
+}
+
+func TestJoint(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m))
+
+	read, write, budget := c.BornLimiter(), c.BornLimiter(), c.BornLimiter()
+	read.SetCPS(100)
+	write.SetCPS(100)
+	budget.SetCPS(50)
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	r, w := limiter.NewJoint(read, budget), limiter.NewJoint(write, budget)
+
+	if actual := r.FillUp(100); actual != 100 {
+		t.Errorf("expected 100, got %d", actual)
+	}
+
+	if actual := w.FillUp(100); actual != 50 {
+		t.Errorf("expected 50, got %d", actual)
+	}
+
+	// the partial grant is returned to the write Limiter
+	if actual := write.FillUp(1000); actual != 250 {
+		t.Errorf("expected 250, got %d", actual)
+	}
+
+	done := make(chan int64)
+	go func() {
+		granted, err := r.WaitN(context.Background(), 10)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		done <- granted
+	}()
+
+	m.BlockUntil(1)
+	m.Advance(interval)
+
+	if granted := <-done; granted != 10 {
+		t.Errorf("expected 10, got %d", granted)
+	}
+
+	for i, l := range r.Limiters() {
+		if actual := l.Stats().Throttled; actual != interval {
+			t.Errorf("%d: expected %v, got %v", i, interval, actual)
+		}
+	}
+
+	if err := testPanic(func() { limiter.NewJoint() }); !errors.Is(err.(error), limiter.ErrInvalidParams) {
+		t.Errorf("expected %v, got %v", limiter.ErrInvalidParams, err)
+	}
+}
+
+func TestMinCPS(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m))
+
+	guaranteed, other := c.BornLimiter(), c.BornLimiter()
+
+	if err := guaranteed.SetMinCPS(50); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	if actual := other.FillUp(1000); actual != 150 {
+		t.Errorf("expected 150, got %d", actual)
+	}
+
+	if actual := guaranteed.FillUp(1000); actual != 150 {
+		t.Errorf("expected 150, got %d", actual)
+	}
+
+	if err := other.SetMinCPS(60); !errors.Is(err, limiter.ErrOvercommitted) {
+		t.Errorf("expected %v, got %v", limiter.ErrOvercommitted, err)
+	}
+
+	if actual := c.ReservedCPS(); actual != 50 {
+		t.Errorf("expected 50, got %d", actual)
+	}
+
+	if err := other.SetMinCPS(50); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	guaranteed.Release()
+
+	if actual := c.ReservedCPS(); actual != 50 {
+		t.Errorf("expected 50, got %d", actual)
+	}
+
+	// the floor is not granted to the released one anymore
+	if actual := guaranteed.MinCPS(); actual != 0 {
+		t.Errorf("expected 0, got %d", actual)
+	}
+
+	if err := other.SetMinCPS(0); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	if actual := c.ReservedCPS(); actual != 0 {
+		t.Errorf("expected 0, got %d", actual)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m))
+	l := c.BornLimiter()
+	l.SetName("test")
+
+	var limiterEvents, controllerEvents []limiter.Event
+	l.OnEvent(func(e limiter.Event) { limiterEvents = append(limiterEvents, e) })
+	c.OnEvent(func(e limiter.Event) { controllerEvents = append(controllerEvents, e) })
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	granted := l.FillUp(1000)
+	if granted <= 0 || granted >= 1000 {
+		t.Fatalf("expected partial grant, got %d", granted)
+	}
+
+	if len(limiterEvents) != 1 || len(controllerEvents) != 1 {
+		t.Fatalf("expected 1 event each, got %d and %d", len(limiterEvents), len(controllerEvents))
+	}
+
+	e := controllerEvents[0]
+	if e.Kind != limiter.EventThrottled || e.Limiter != l || e.Limiter.Name() != "test" ||
+		e.Requested != 1000 || e.Granted != granted || e.Waited != 0 {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	done := make(chan int64)
+	go func() {
+		granted, _ := l.WaitN(context.Background(), 10)
+		done <- granted
+	}()
+
+	m.BlockUntil(1)
+	m.Advance(interval)
+
+	if granted := <-done; granted != 10 {
+		t.Errorf("expected 10, got %d", granted)
+	}
+
+	if len(limiterEvents) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(limiterEvents))
+	}
+
+	if e := limiterEvents[1]; e.Kind != limiter.EventThrottled || e.Requested != 10 || e.Granted != 10 || e.Waited <= 0 {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	l.OnEvent(nil)
+	l.Report(limiter.Event{Kind: limiter.EventExceeded})
+
+	if len(limiterEvents) != 2 || len(controllerEvents) != 3 {
+		t.Errorf("expected 2 and 3 events, got %d and %d", len(limiterEvents), len(controllerEvents))
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m))
+	child := c.BornController(0, 0)
+	l := child.BornLimiter()
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	if actual := l.FillUp(1000); actual != 300 {
+		t.Errorf("expected 300, got %d", actual)
+	}
+
+	if err := c.Reconfigure(2*interval, ticks/10); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if i, n := child.Window(); i != 2*interval || n != ticks/10 {
+		t.Errorf("expected (%v, %d), got (%v, %d)", 2*interval, ticks/10, i, n)
+	}
+
+	// the time not measured is treated as used at the average rate, up to a tick worth is left
+	if actual := l.FillUp(1000); actual > 600/(ticks/10) {
+		t.Errorf("expected no more than %d, got %d", 600/(ticks/10), actual)
+	}
+
+	m.Advance(2 * interval)
+
+	if actual := l.FillUp(1000); actual != 600 {
+		t.Errorf("expected 600, got %d", actual)
+	}
+
+	// all the 600 were measured in the last second
+	if err := c.Reconfigure(time.Second, ticks); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if actual := l.FillUp(1000); actual != 0 {
+		t.Errorf("expected 0, got %d", actual)
+	}
+
+	m.Advance(time.Second)
+
+	if actual := l.FillUp(1000); actual != 100 {
+		t.Errorf("expected 100, got %d", actual)
+	}
+
+	if err := c.Reconfigure(time.Second, 0); !errors.Is(err, limiter.ErrInvalidParams) {
+		t.Errorf("expected %v, got %v", limiter.ErrInvalidParams, err)
+	}
+}
+
+func TestAllowWait(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := limiter.NewController(interval, ticks, 10, 0, limiter.WithClock(m)).BornLimiter()
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	for i, c := range []struct {
+		cost     int64
+		expected bool
+	}{{20, true}, {20, false}, {10, true}, {1, false}, {0, true}} {
+		if actual := l.Allow(c.cost); actual != c.expected {
+			t.Errorf("%d: expected %v, got %v", i, c.expected, actual)
+		}
+	}
+
+	// nothing is granted on the operations not allowed
+	if s := l.Stats(); s.Granted != 30 || s.Denials != 2 {
+		t.Errorf("expected 30 granted and 2 denials, got %+v", s)
+	}
+
+	if err := l.Wait(context.Background(), 40); !errors.Is(err, limiter.ErrInvalidParams) {
+		t.Errorf("expected %v, got %v", limiter.ErrInvalidParams, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- l.Wait(ctx, 10)
+	}()
+
+	m.BlockUntil(1)
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	go func() {
+		done <- l.Wait(context.Background(), 10)
+	}()
+
+	m.BlockUntil(1)
+	m.Advance(interval)
+
+	if err := <-done; err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	if s := l.Stats(); s.Throttled <= 0 {
+		t.Errorf("expected throttled, got %+v", s)
+	}
+}
+
+func TestComposite(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	bytes := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m)).BornLimiter()
+	ops := limiter.NewController(interval, ticks, 1, 0, limiter.WithClock(m)).BornLimiter()
+
+	c := limiter.NewComposite(
+		limiter.Dimension{Limiter: bytes, PerUnit: 1},
+		limiter.Dimension{Limiter: ops, PerCall: 1},
+	)
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	// 300 bytes and 3 ops per interval
+	for i, expected := range []int64{200, 100, 0} {
+		if actual := c.FillUp(200); actual != expected {
+			t.Errorf("%d: expected %d, got %d", i, expected, actual)
+		}
+	}
+
+	m.Advance(interval)
+
+	for i, expected := range []int64{10, 10, 10, 0} {
+		if actual := c.FillUp(10); actual != expected {
+			t.Errorf("%d: expected %d, got %d", i, expected, actual)
+		}
+	}
+
+	// the bytes are returned back on the ops exhausted
+	if actual := bytes.FillUp(1000); actual != 270 {
+		t.Errorf("expected 270, got %d", actual)
+	}
+
+	done := make(chan int64)
+	go func() {
+		granted, _ := c.WaitN(context.Background(), 10)
+		done <- granted
+	}()
+
+	m.BlockUntil(1)
+	m.Advance(interval)
+
+	if granted := <-done; granted != 10 {
+		t.Errorf("expected 10, got %d", granted)
+	}
+
+	// a call costs an op once, the waits are not counted
+	if actual := ops.Stats().Requested; actual != 8 {
+		t.Errorf("expected 8, got %d", actual)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("expected panic")
+			}
+		}()
+
+		limiter.NewComposite(limiter.Dimension{Limiter: ops})
+	}()
+}
+
+// wait moves m from a Timer to a Timer until done receives a value and returns it,
+// failing t if no Timer is set for a second, e.g. WaitN is spinning instead of sleeping.
+func wait(t *testing.T, m *clocktest.Manual, done <-chan int64) int64 {
+	t.Helper()
+
+	for start := time.Now(); ; runtime.Gosched() {
+		select {
+		case v := <-done:
+			return v
+		default:
+		}
+
+		if m.Next() {
+			start = time.Now()
+			continue
+		}
+
+		if time.Since(start) > time.Second {
+			t.Fatalf("no timer set")
+		}
+	}
+}
+
+// contended returns a Limiter denied by its fair share, while the Controller has 300 free.
+// The share allows it to get more two ticks later.
+func contended(t *testing.T) (*clocktest.Manual, *limiter.Limiter) {
+	t.Helper()
+
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := limiter.NewController(interval, ticks, 200, 0, limiter.WithClock(m))
+	x, y := c.BornLimiter(), c.BornLimiter()
+	tick := interval / ticks
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	if actual := x.FillUp(600); actual != 600 {
+		t.Errorf("expected 600, got %d", actual)
+	}
+
+	// both are demanding 600 of 600 now, the share is 300 each
+	m.Advance(tick)
+	y.FillUp(600)
+	m.Advance(tick)
+	x.FillUp(600)
+
+	// the first x grant is gone, y takes its share leaving 300 free
+	m.Advance(interval - tick*2)
+
+	if actual := y.FillUp(600); actual != 300 {
+		t.Errorf("expected 300, got %d", actual)
+	}
+
+	return m, y
+}
+
+func TestWeightsWaitN(t *testing.T) {
+	m, y := contended(t)
+	tick := interval / ticks
+	start := m.Now()
+
+	done := make(chan int64, 1)
+	go func() {
+		granted, err := y.WaitN(context.Background(), 1)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		done <- granted
+	}()
+
+	if granted := wait(t, m, done); granted != 1 {
+		t.Errorf("expected 1, got %d", granted)
+	}
+
+	// y is waiting for x to stop demanding
+	if waited := m.Now().Sub(start); waited != tick*2 {
+		t.Errorf("expected %v, got %v", tick*2, waited)
+	}
+}
+
+func TestMinCPSWaitN(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m))
+	x, y := c.BornLimiter(), c.BornLimiter()
+
+	if err := y.SetMinCPS(50); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	// the rest is free, but guaranteed to y
+	if actual := x.FillUp(1000); actual != 150 {
+		t.Errorf("expected 150, got %d", actual)
+	}
+
+	start := m.Now()
+
+	done := make(chan int64, 1)
+	go func() {
+		granted, err := x.WaitN(context.Background(), 1)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		done <- granted
+	}()
+
+	if granted := wait(t, m, done); granted != 1 {
+		t.Errorf("expected 1, got %d", granted)
+	}
+
+	if waited := m.Now().Sub(start); waited != interval {
+		t.Errorf("expected %v, got %v", interval, waited)
+	}
+}
+
+func TestJointWaitNCounted(t *testing.T) {
+	m, y := contended(t)
+	z := limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m)).BornLimiter()
+	j := limiter.NewJoint(y, z)
+
+	var throttled int64
+	z.OnEvent(func(e limiter.Event) {
+		if e.Kind == limiter.EventThrottled {
+			atomic.AddInt64(&throttled, 1)
+		}
+	})
+
+	before := y.Stats()
+
+	done := make(chan int64, 1)
+	go func() {
+		granted, err := j.WaitN(context.Background(), 10)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		done <- granted
+	}()
+
+	if granted := wait(t, m, done); granted != 10 {
+		t.Errorf("expected 10, got %d", granted)
+	}
+
+	// the retries after the waits are not counted
+	after := y.Stats()
+	if actual := after.Requested - before.Requested; actual != 10 {
+		t.Errorf("expected 10, got %d", actual)
+	}
+
+	if actual := after.Denials - before.Denials; actual != 1 {
+		t.Errorf("expected 1, got %d", actual)
+	}
+
+	expected := limiter.Stats{Granted: 10, Requested: 10, Denials: 1, Throttled: interval / ticks * 2, Rate: 10 / interval.Seconds()}
+	if actual := z.Stats(); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	if actual := atomic.LoadInt64(&throttled); actual != 1 {
+		t.Errorf("expected 1, got %d", actual)
+	}
+}
+
+func TestIdleLimiters(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m))
+	y := c.BornLimiter()
+
+	collected := make(chan struct{})
+	func() {
+		x := c.BornLimiter()
+		x.FillUp(10)
+		runtime.SetFinalizer(x, func(*limiter.Limiter) { close(collected) })
+	}()
+
+	// x is not released, but is dropped being idle
+	m.Advance(interval)
+	y.FillUp(10)
+
+	if ll := c.Limiters(); len(ll) != 1 || ll[0] != y {
+		t.Errorf("expected [%p], got %v", y, ll)
+	}
+
+	for i := 0; ; i++ {
+		runtime.GC()
+
+		select {
+		case <-collected:
+		case <-time.After(time.Millisecond * 10):
+			if i < 100 {
+				continue
+			}
+			t.Errorf("the limiter is not collected")
+		}
+
+		break
+	}
+
+	// y is dropped and registered back on use
+	m.Advance(interval)
+	z := c.BornLimiter()
+
+	if ll := c.Limiters(); len(ll) != 1 || ll[0] != z {
+		t.Errorf("expected [%p], got %v", z, ll)
+	}
+
+	y.FillUp(10)
+
+	if n := len(c.Limiters()); n != 2 {
+		t.Errorf("expected 2, got %d", n)
+	}
+}
@@ -0,0 +1,72 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+)
+
+// Allow tells if the operation costing cost units is allowed now.
+// The whole cost is granted or nothing, so it fits the requests, messages or IOPS limiting,
+// where FillUp fits the bytes.
+// EventThrottled is reported in case the operation is not allowed.
+func (l *Limiter) Allow(cost int64) bool {
+	if cost <= 0 {
+		return true
+	}
+
+	granted := l.grant(cost)
+	if granted < cost {
+		l.add(-granted)
+		granted = 0
+	}
+
+	l.account(func(s *stats) { s.request(cost, granted) })
+
+	if granted == 0 {
+		l.Report(Event{Kind: EventThrottled, Requested: cost})
+		return false
+	}
+
+	return true
+}
+
+// Wait blocks until the operation costing cost units is allowed, the whole cost is granted at once.
+// Returns ctx.Err() in case ctx is done before, the cost is returned back then,
+// ErrQuotaExhausted in case the quotas left are less than cost,
+// and ErrInvalidParams in case cost is bigger than the limits allow for the interval.
+// Time spent waiting is reported to the Limiter stats as throttled.
+func (l *Limiter) Wait(ctx context.Context, cost int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if left, _ := l.QuotaLeft(); cost > left {
+		return ErrQuotaExhausted
+	}
+
+	r := l.Reserve(cost)
+	if !r.OK() {
+		return fmt.Errorf("cost: %d: %w", cost, ErrInvalidParams)
+	}
+
+	d := r.Delay()
+	if d <= 0 {
+		return nil
+	}
+
+	startTime := l.controller.clock.Now()
+	defer func() {
+		spent := l.controller.clock.Now().Sub(startTime)
+		l.account(func(s *stats) { s.throttle(spent) })
+	}()
+
+	timer := l.controller.clock.NewTimer(d)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		r.Cancel()
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
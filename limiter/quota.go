@@ -0,0 +1,200 @@
+package limiter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Period is a calendar period a Quota is renewed every.
+type Period int
+
+// Periods
+const (
+	PeriodHour Period = iota + 1
+	PeriodDay
+	PeriodMonth
+)
+
+// Quota is a volume limit for a calendar period, checked along with the rate limits.
+type Quota struct {
+	// Amount allowed for the Period, not positive means no quota.
+	Amount int64
+	// Period the Amount is renewed every, zero means never.
+	Period Period
+	// Location the Period boundaries are defined in, time.Local is used for nil.
+	Location *time.Location
+}
+
+type quota struct {
+	Quota
+	used    int64
+	resetAt time.Time
+	lock    sync.Mutex
+}
+
+func newQuota() *quota {
+	return &quota{}
+}
+
+// set changes the quota, the amount used is kept unless the period is changed.
+func (q *quota) set(quota Quota, now time.Time) {
+	if quota.Location == nil {
+		quota.Location = time.Local
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if quota.Period != q.Period || quota.Location != q.Location {
+		q.used = 0
+		q.resetAt = quota.next(now)
+	}
+
+	q.Quota = quota
+}
+
+// take adds up to n not exceeding the Amount. Returns an actual amount was added.
+func (q *quota) take(now time.Time, n int64) int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.Amount <= 0 {
+		return n
+	}
+
+	q.renewLocked(now)
+
+	if left := q.Amount - q.used; left < n {
+		n = maxInt64(left, 0)
+	}
+
+	q.used += n
+
+	return n
+}
+
+// fillUp adds n unconditionally, negative n returns the amount back.
+func (q *quota) fillUp(now time.Time, n int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.Amount <= 0 {
+		return
+	}
+
+	q.renewLocked(now)
+
+	// the amount taken before the renewal is not returned
+	q.used = maxInt64(q.used+n, 0)
+}
+
+// left returns an amount left and a time the quota is renewed at, zero for never.
+func (q *quota) left(now time.Time) (int64, time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.Amount <= 0 {
+		return math.MaxInt64, time.Time{}
+	}
+
+	q.renewLocked(now)
+
+	return maxInt64(q.Amount-q.used, 0), q.resetAt
+}
+
+func (q *quota) renewLocked(now time.Time) {
+	if q.resetAt.IsZero() || now.Before(q.resetAt) {
+		return
+	}
+
+	q.used = 0
+	q.resetAt = q.next(now)
+}
+
+// next returns the Period boundary after t.
+func (q Quota) next(t time.Time) time.Time {
+	t = t.In(q.Location)
+
+	switch q.Period {
+	case PeriodHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+	case PeriodDay:
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+	case PeriodMonth:
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+	}
+
+	return time.Time{}
+}
+
+// SetQuota sets the Limiter volume quota, the amount used within the current period is kept.
+// Zero Quota removes it.
+func (l *Limiter) SetQuota(q Quota) {
+	l.quota.set(q, l.controller.clock.Now())
+}
+
+// QuotaLeft returns an amount the Limiter is allowed to get until the quota renewal, and the renewal time.
+// Quotas of all the Controllers up to the root one are applied, the one with the least amount left is returned.
+// math.MaxInt64 and zero time are returned when there is no quota.
+func (l *Limiter) QuotaLeft() (int64, time.Time) {
+	now := l.controller.clock.Now()
+
+	left, resetAt := l.quota.left(now)
+	if cl, cr := l.controller.quotaLeft(now); cl < left {
+		left, resetAt = cl, cr
+	}
+
+	return left, resetAt
+}
+
+// SetQuota sets the volume quota common for all the derrived Limiters,
+// the amount used within the current period is kept.
+// Zero Quota removes it.
+func (c *Controller) SetQuota(q Quota) {
+	c.quota.set(q, c.clock.Now())
+}
+
+// QuotaLeft returns an amount the derrived Limiters are allowed to get together until the quota renewal,
+// and the renewal time. Quotas of all the Controllers up to the root one are applied.
+// math.MaxInt64 and zero time are returned when there is no quota.
+func (c *Controller) QuotaLeft() (int64, time.Time) {
+	return c.quotaLeft(c.clock.Now())
+}
+
+func (c *Controller) quotaLeft(now time.Time) (int64, time.Time) {
+	left, resetAt := int64(math.MaxInt64), time.Time{}
+	for ; c != nil; c = c.parent {
+		if cl, cr := c.quota.left(now); cl < left {
+			left, resetAt = cl, cr
+		}
+	}
+
+	return left, resetAt
+}
+
+// takeQuota takes up to n from the Limiter and all the Controllers quotas.
+// Partial amounts are returned back to the ones passed already.
+func (l *Limiter) takeQuota(now time.Time, n int64) int64 {
+	n = l.quota.take(now, n)
+
+	for c := l.controller; c != nil && n > 0; c = c.parent {
+		if taken := c.quota.take(now, n); taken < n {
+			l.quota.fillUp(now, taken-n)
+			for r := l.controller; r != c; r = r.parent {
+				r.quota.fillUp(now, taken-n)
+			}
+			n = taken
+		}
+	}
+
+	return n
+}
+
+// fillUpQuota adds n to the Limiter and all the Controllers quotas unconditionally.
+func (l *Limiter) fillUpQuota(now time.Time, n int64) {
+	l.quota.fillUp(now, n)
+	for c := l.controller; c != nil; c = c.parent {
+		c.quota.fillUp(now, n)
+	}
+}
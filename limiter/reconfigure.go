@@ -0,0 +1,55 @@
+package limiter
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Reconfigure changes the interval and the ticks of the Controller, the live Limiters and the nested Controllers.
+// The measures taken are migrated to the new window, so the accounted history is not lost and no burst is granted:
+// for SlidingWindow the measures are spread over the new ticks,
+// and in case the interval grows the time not measured is treated as used at the average rate.
+// For the bucket algorithms the part of the burst used stays the same, in case the burst depends on the interval.
+// Released Limiters and Controllers keep the old window, the idle Limiters are moved to the new one on the next use.
+// Returns ErrInvalidParams in case the tick is shorter than a nanosecond or the algorithm is not a Resizer.
+func (c *Controller) Reconfigure(interval time.Duration, ticks uint) error {
+	if ticks == 0 || interval/time.Duration(ticks) <= 0 {
+		return fmt.Errorf("interval: %v, ticks: %d: %w", interval, ticks, ErrInvalidParams)
+	}
+
+	if _, ok := c.counter.(Resizer); !ok {
+		return fmt.Errorf("algorithm: %T: %w", c.counter, ErrInvalidParams)
+	}
+
+	c.reconfigure(interval, ticks)
+
+	return nil
+}
+
+func (c *Controller) reconfigure(interval time.Duration, ticks uint) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	atomic.StoreInt64(&c.interval, int64(interval))
+	atomic.StoreInt64(&c.ticks, int64(ticks))
+
+	c.counter.(Resizer).Resize(interval, ticks)
+	c.stats.resize(interval, ticks)
+	c.named.Range(func(_, s interface{}) bool {
+		s.(*stats).resize(interval, ticks)
+		return true
+	})
+
+	for l := range c.limiters {
+		l.counter.(Resizer).Resize(interval, ticks)
+		if s := l.tracked(); s != nil {
+			s.resize(interval, ticks)
+		}
+		l.stats.resize(interval, ticks)
+	}
+
+	for child := range c.children {
+		child.reconfigure(interval, ticks)
+	}
+}
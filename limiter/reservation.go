@@ -0,0 +1,240 @@
+package limiter
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reservation holds an amount reserved on a Limiter to be used after a delay.
+type Reservation struct {
+	limiter   *Limiter
+	n         int64
+	ok        bool
+	timeToAct time.Time
+	deferral  *deferral
+	canceled  int32
+}
+
+// Reserve reserves n on the Limiter and all the Controllers up to the root one.
+// Returned Reservation tells how long to wait before n is available.
+// Reservation is not OK in case n is bigger than the limits allow for the interval, or than the quotas left.
+// The amount reserved for later is counted as used at the time to act, not at the time reserved,
+// and nothing else is granted in place of it meanwhile.
+func (l *Limiter) Reserve(n int64) *Reservation {
+	now := l.controller.clock.Now()
+
+	r := &Reservation{
+		limiter:   l,
+		n:         n,
+		timeToAct: now,
+	}
+
+	switch {
+	case n <= 0:
+		r.ok = true
+		return r
+	case n > l.capacity():
+		return r
+	}
+
+	if left, _ := l.QuotaLeft(); n > left {
+		return r
+	}
+
+	r.ok = true
+
+	granted := l.grant(n)
+	if granted == n {
+		l.record(n, n)
+		return r
+	}
+
+	// the whole n is used at once after the delay, so nothing is taken now
+	l.add(-granted)
+
+	r.timeToAct = now.Add(l.delay(n))
+	r.deferral = &deferral{at: r.timeToAct, n: n}
+
+	l.deferred.push(r.deferral)
+	for c := l.controller; c != nil; c = c.parent {
+		c.deferred.push(r.deferral)
+	}
+
+	l.fillUpQuota(now, n)
+	if s := l.tracked(); s != nil {
+		s.usage.FillUp(n)
+	}
+	l.record(n, 0)
+	l.account(func(s *stats) { s.grant(n) })
+
+	l.Report(Event{Kind: EventThrottled, Requested: n})
+
+	return r
+}
+
+// OK returns true if the amount was reserved.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns a time to wait before the reserved amount is available.
+func (r *Reservation) Delay() time.Duration {
+	if d := r.timeToAct.Sub(r.limiter.controller.clock.Now()); d > 0 {
+		return d
+	}
+
+	return 0
+}
+
+// Cancel returns the reserved amount to the Limiter and the Controllers.
+// Does nothing if the reservation was not OK, canceled already, or the time to act is passed, so the amount is used.
+func (r *Reservation) Cancel() {
+	if !r.ok || r.n <= 0 || !atomic.CompareAndSwapInt32(&r.canceled, 0, 1) {
+		return
+	}
+
+	l := r.limiter
+	now := l.controller.clock.Now()
+
+	if now.After(r.timeToAct) {
+		return
+	}
+
+	if r.deferral == nil {
+		l.FillUp(-r.n)
+		return
+	}
+
+	// the amount is dropped unless it was added to the counter already
+	if !l.deferred.remove(r.deferral) {
+		l.counter.FillUp(-r.n)
+	}
+	for c := l.controller; c != nil; c = c.parent {
+		if !c.deferred.remove(r.deferral) {
+			c.counter.FillUp(-r.n)
+		}
+	}
+
+	l.fillUpQuota(now, -r.n)
+	if s := l.tracked(); s != nil {
+		s.usage.FillUp(-r.n)
+	}
+	l.account(func(s *stats) { s.grant(-r.n) })
+}
+
+// deferral is an amount reserved to be used at.
+type deferral struct {
+	at time.Time
+	n  int64
+}
+
+// deferred holds the amounts reserved for later on a Limiter or a Controller.
+// They are added to the counter once due, so they leave the sliding window an interval after they are used,
+// and are treated as used already until then.
+type deferred struct {
+	lock      sync.Mutex
+	deferrals []*deferral // the earliest first
+	total     int64       // not due yet, accessed atomically to skip the lock in case nothing is deferred
+}
+
+func (d *deferred) push(e *deferral) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	i := sort.Search(len(d.deferrals), func(i int) bool { return d.deferrals[i].at.After(e.at) })
+	d.deferrals = append(d.deferrals, nil)
+	copy(d.deferrals[i+1:], d.deferrals[i:])
+	d.deferrals[i] = e
+
+	atomic.AddInt64(&d.total, e.n)
+}
+
+// remove drops e not due yet. Returns false in case it is added to the counter already.
+func (d *deferred) remove(e *deferral) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i, v := range d.deferrals {
+		if v == e {
+			d.deferrals = append(d.deferrals[:i], d.deferrals[i+1:]...)
+			atomic.AddInt64(&d.total, -e.n)
+			return true
+		}
+	}
+
+	return false
+}
+
+// settleLocked adds the amounts due to a.
+// The ones due the interval ago or earlier are out of the window already, so they are just dropped.
+func (d *deferred) settleLocked(a Algorithm, now time.Time, interval time.Duration) {
+	i := 0
+	for ; i < len(d.deferrals) && !d.deferrals[i].at.After(now); i++ {
+		if now.Sub(d.deferrals[i].at) < interval {
+			a.FillUp(d.deferrals[i].n)
+		}
+		atomic.AddInt64(&d.total, -d.deferrals[i].n)
+	}
+
+	d.deferrals = d.deferrals[i:]
+}
+
+// fillUpToCap is a.FillUpToCap treating the amounts not due yet as used.
+func (d *deferred) fillUpToCap(a Algorithm, now time.Time, interval time.Duration, n int64, cps int64) int64 {
+	if atomic.LoadInt64(&d.total) == 0 {
+		return a.FillUpToCap(n, cps)
+	}
+
+	d.lock.Lock()
+	d.settleLocked(a, now, interval)
+	pending := atomic.LoadInt64(&d.total)
+	d.lock.Unlock()
+
+	allowed := a.FillUpToCap(n+pending, cps)
+	if allowed <= pending {
+		a.FillUp(-allowed)
+		return 0
+	}
+
+	a.FillUp(-pending)
+
+	return allowed - pending
+}
+
+// delay is a.Delay treating the amounts not due yet as used from the time they are due for the interval.
+// In case n does not fit along with all of them, it waits for the earliest ones to leave the window.
+func (d *deferred) delay(a Algorithm, now time.Time, interval time.Duration, n int64, cps int64) time.Duration {
+	if atomic.LoadInt64(&d.total) == 0 {
+		return a.Delay(n, cps)
+	}
+
+	d.lock.Lock()
+	d.settleLocked(a, now, interval)
+
+	var (
+		pending  = atomic.LoadInt64(&d.total)
+		capacity = a.Capacity(cps)
+		after    time.Duration
+	)
+
+	for _, e := range d.deferrals {
+		if n+pending <= capacity {
+			break
+		}
+		pending -= e.n
+		after = e.at.Add(interval).Sub(now)
+	}
+
+	d.lock.Unlock()
+
+	return maxDuration(after, a.Delay(n+pending, cps))
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
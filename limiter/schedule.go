@@ -0,0 +1,233 @@
+package limiter
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Window is a time of day period the limits are applied within.
+type Window struct {
+	// Weekdays the Window starts on, empty means every day.
+	Weekdays []time.Weekday
+	// Start and End are offsets from the midnight, both are within [0, 24h).
+	// End not after Start means the Window lasts over the midnight.
+	Start time.Duration
+	End   time.Duration
+	// CommonCPS and PerChildCPS are applied within the Window, not positive means no limit.
+	CommonCPS   int64
+	PerChildCPS int64
+}
+
+// Schedule is a set of Windows mapped to the limits.
+// The first Window matching the time is applied, CommonCPS and PerChildCPS are applied outside all of them.
+type Schedule struct {
+	// Location the Windows are defined in, time.Local is used for nil.
+	Location    *time.Location
+	Windows     []Window
+	CommonCPS   int64
+	PerChildCPS int64
+}
+
+// SetSchedule starts applying the schedule to the Controller, the one set before is stopped.
+// nil stops the current schedule, leaving the limits as they are.
+// Limits are changed the same way SetCommonCPS and SetPerChildCPS do,
+// so the new rate is in effect right from the transition, neither a burst nor a stall is carried over
+// from the measurement interval started with the old limits.
+func (c *Controller) SetSchedule(s *Schedule) error {
+	if s != nil {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	if c.stopSchedule != nil {
+		close(c.stopSchedule)
+		c.stopSchedule = nil
+	}
+
+	if s == nil {
+		c.lock.Unlock()
+		return nil
+	}
+
+	stop := make(chan struct{})
+	c.stopSchedule = stop
+	c.lock.Unlock()
+
+	now := c.clock.Now()
+	c.applySchedule(s, now)
+
+	go c.runSchedule(s, now, stop)
+
+	return nil
+}
+
+func (c *Controller) runSchedule(s *Schedule, now time.Time, stop chan struct{}) {
+	for {
+		next := s.next(now)
+
+		timer := c.clock.NewTimer(next.Sub(c.clock.Now()))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		now = next
+		if t := c.clock.Now(); t.After(now) {
+			now = t
+		}
+
+		c.lock.Lock()
+		stopped := c.stopSchedule != stop
+		c.lock.Unlock()
+
+		if stopped {
+			return
+		}
+
+		c.applySchedule(s, now)
+	}
+}
+
+// applySchedule sets the limits scheduled for t, the ones not changed are left intact.
+func (c *Controller) applySchedule(s *Schedule, t time.Time) {
+	commonCPS, perChildCPS := s.limits(t)
+
+	if normalizeCPS(commonCPS) != c.CommonCPS() {
+		c.SetCommonCPS(commonCPS)
+	}
+
+	if normalizeCPS(perChildCPS) != c.PerChildCPS() {
+		c.SetPerChildCPS(perChildCPS)
+	}
+}
+
+func (s *Schedule) validate() error {
+	for i, w := range s.Windows {
+		if w.Start < 0 || w.Start >= day || w.End < 0 || w.End >= day {
+			return fmt.Errorf("window %d: %v-%v: %w", i, w.Start, w.End, ErrInvalidParams)
+		}
+	}
+
+	return nil
+}
+
+func (s *Schedule) location() *time.Location {
+	if s.Location == nil {
+		return time.Local
+	}
+
+	return s.Location
+}
+
+// limits returns the limits scheduled for t.
+func (s *Schedule) limits(t time.Time) (int64, int64) {
+	t = t.In(s.location())
+
+	for _, w := range s.Windows {
+		if w.contains(t) {
+			return w.CommonCPS, w.PerChildCPS
+		}
+	}
+
+	return s.CommonCPS, s.PerChildCPS
+}
+
+// next returns the first Window boundary after t.
+func (s *Schedule) next(t time.Time) time.Time {
+	t = t.In(s.location())
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+	// the day before is checked as well, the Window started on it could end today
+	var next time.Time
+	for d := -1; d <= 7; d++ {
+		date := midnight.AddDate(0, 0, d)
+		for _, w := range s.Windows {
+			if !w.startsOn(date.Weekday()) {
+				continue
+			}
+
+			for _, b := range w.boundaries(date) {
+				if b.After(t) && (next.IsZero() || b.Before(next)) {
+					next = b
+				}
+			}
+		}
+	}
+
+	if next.IsZero() {
+		// nothing is scheduled, so just check once a day
+		next = midnight.AddDate(0, 0, 1)
+	}
+
+	return next
+}
+
+const day = time.Hour * 24
+
+func (w *Window) startsOn(weekday time.Weekday) bool {
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+
+	for _, d := range w.Weekdays {
+		if d == weekday {
+			return true
+		}
+	}
+
+	return false
+}
+
+// boundaries returns the Window start and end on the date provided.
+func (w *Window) boundaries(date time.Time) [2]time.Time {
+	endDate := date
+	if w.End <= w.Start {
+		endDate = date.AddDate(0, 0, 1)
+	}
+
+	return [2]time.Time{atOffset(date, w.Start), atOffset(endDate, w.End)}
+}
+
+func (w *Window) contains(t time.Time) bool {
+	date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+	for _, d := range []time.Time{date, date.AddDate(0, 0, -1)} {
+		if !w.startsOn(d.Weekday()) {
+			continue
+		}
+
+		b := w.boundaries(d)
+		if !t.Before(b[0]) && t.Before(b[1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// atOffset returns a wall clock time offset from the date midnight, so DST changes are respected.
+func atOffset(date time.Time, offset time.Duration) time.Time {
+	return time.Date(
+		date.Year(),
+		date.Month(),
+		date.Day(),
+		int(offset/time.Hour),
+		int(offset%time.Hour/time.Minute),
+		int(offset%time.Minute/time.Second),
+		int(offset%time.Second),
+		date.Location(),
+	)
+}
+
+func normalizeCPS(cps int64) int64 {
+	if cps <= 0 {
+		return math.MaxInt64
+	}
+
+	return cps
+}
@@ -0,0 +1,91 @@
+package limiter
+
+import (
+	"encoding"
+	"fmt"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+)
+
+// State is a serializable Limiter or Controller state, to be encoded with encoding/json, encoding/gob or so.
+// Only the measures are included: the limits, weight and quota are the configuration,
+// so they are to be set before the state is restored, as changing them resets the measures.
+type State struct {
+	// Time the state was taken at.
+	Time time.Time `json:"time"`
+	// Counter is the Algorithm state.
+	Counter []byte `json:"counter"`
+	// QuotaUsed is an amount used within the quota period ends at QuotaResetAt.
+	QuotaUsed    int64     `json:"quotaUsed,omitempty"`
+	QuotaResetAt time.Time `json:"quotaResetAt,omitempty"`
+}
+
+// State returns the Limiter state.
+// ErrInvalidParams is returned in case the Algorithm does not implement encoding.BinaryMarshaler,
+// the built in ones do.
+func (l *Limiter) State() (State, error) {
+	return state(l.controller.clock, l.counter, l.quota)
+}
+
+// Restore restores the Limiter state, the time passed since the state was taken is accounted as usual.
+// ErrInvalidParams is returned in case the state was taken with some other algorithm or ticks number.
+func (l *Limiter) Restore(s State) error {
+	return restore(s, l.counter, l.quota)
+}
+
+// State returns the Controller own state, the derrived Limiters and Controllers are not included.
+// ErrInvalidParams is returned in case the Algorithm does not implement encoding.BinaryMarshaler,
+// the built in ones do.
+func (c *Controller) State() (State, error) {
+	return state(c.clock, c.counter, c.quota)
+}
+
+// Restore restores the Controller own state, the time passed since the state was taken is accounted as usual.
+// ErrInvalidParams is returned in case the state was taken with some other algorithm or ticks number.
+func (c *Controller) Restore(s State) error {
+	return restore(s, c.counter, c.quota)
+}
+
+func state(c clock.Clock, counter Algorithm, q *quota) (State, error) {
+	m, ok := counter.(encoding.BinaryMarshaler)
+	if !ok {
+		return State{}, fmt.Errorf("%T: state not supported: %w", counter, ErrInvalidParams)
+	}
+
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return State{}, fmt.Errorf("%T: %v: %w", counter, err, ErrInvalidParams)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return State{
+		Time:         c.Now(),
+		Counter:      b,
+		QuotaUsed:    q.used,
+		QuotaResetAt: q.resetAt,
+	}, nil
+}
+
+func restore(s State, counter Algorithm, q *quota) error {
+	u, ok := counter.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%T: state not supported: %w", counter, ErrInvalidParams)
+	}
+
+	if err := u.UnmarshalBinary(s.Counter); err != nil {
+		return fmt.Errorf("%T: %v: %w", counter, err, ErrInvalidParams)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.used = s.QuotaUsed
+	if !s.QuotaResetAt.IsZero() {
+		q.resetAt = s.QuotaResetAt
+	}
+
+	return nil
+}
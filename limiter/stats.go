@@ -0,0 +1,122 @@
+package limiter
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/internal/counter"
+)
+
+// Stats is a statistics snapshot of a Limiter or a Controller.
+// Controller stats include all the Limiters born by it and by the nested Controllers.
+type Stats struct {
+	// Granted is a total amount granted, the amounts returned back are subtracted.
+	Granted int64
+	// Requested is a total amount requested.
+	Requested int64
+	// Denials is a number of requests got nothing at once.
+	Denials int64
+	// Throttled is a cumulative time spent waiting for the grants in WaitN.
+	Throttled time.Duration
+	// Rate is an amount granted per second for the last interval.
+	Rate float64
+}
+
+type stats struct {
+	granted   int64
+	requested int64
+	denials   int64
+	throttled int64
+	interval  int64 // time.Duration, could be changed by resize
+	rate      *counter.Counter
+}
+
+func newStats(interval time.Duration, ticks uint, clock clock.Clock) *stats {
+	return &stats{
+		interval: int64(interval),
+		rate:     counter.NewCounter(interval, ticks, clock),
+	}
+}
+
+func (s *stats) grant(n int64) {
+	atomic.AddInt64(&s.granted, n)
+	s.rate.FillUp(n)
+}
+
+func (s *stats) request(requested, granted int64) {
+	atomic.AddInt64(&s.requested, requested)
+	if granted <= 0 {
+		atomic.AddInt64(&s.denials, 1)
+		return
+	}
+	s.grant(granted)
+}
+
+func (s *stats) throttle(d time.Duration) {
+	atomic.AddInt64(&s.throttled, int64(d))
+}
+
+func (s *stats) resize(interval time.Duration, ticks uint) {
+	atomic.StoreInt64(&s.interval, int64(interval))
+	s.rate.Resize(interval, ticks)
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Granted:   atomic.LoadInt64(&s.granted),
+		Requested: atomic.LoadInt64(&s.requested),
+		Denials:   atomic.LoadInt64(&s.denials),
+		Throttled: time.Duration(atomic.LoadInt64(&s.throttled)),
+		Rate:      float64(s.rate.FillUp(0)) / time.Duration(atomic.LoadInt64(&s.interval)).Seconds(),
+	}
+}
+
+// Stats returns the Limiter statistics snapshot.
+func (l *Limiter) Stats() Stats {
+	return l.stats.snapshot()
+}
+
+// Stats returns the Controller statistics snapshot.
+func (c *Controller) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// NamedStats returns the statistics snapshots of the Limiters named with SetName, summed up by the name.
+// Limiters born by the nested Controllers are included.
+// The Limiter stats are counted since it is named, and kept after it is released or dropped being idle,
+// so the totals never go back.
+func (c *Controller) NamedStats() map[string]Stats {
+	named := make(map[string]Stats)
+	c.named.Range(func(name, s interface{}) bool {
+		named[name.(string)] = s.(*stats).snapshot()
+		return true
+	})
+
+	return named
+}
+
+// account reports the stats to the Limiter and all the Controllers up to the root one,
+// the named Limiter ones are reported to the Controllers under the name as well.
+func (l *Limiter) account(f func(s *stats)) {
+	f(l.stats)
+
+	name := l.Name()
+	for c := l.controller; c != nil; c = c.parent {
+		f(c.stats)
+		if name != "" {
+			f(c.namedStats(name))
+		}
+	}
+}
+
+func (c *Controller) namedStats(name string) *stats {
+	if s, ok := c.named.Load(name); ok {
+		return s.(*stats)
+	}
+
+	interval, ticks := c.Window()
+	s, _ := c.named.LoadOrStore(name, newStats(interval, ticks, c.clock))
+
+	return s.(*stats)
+}
@@ -0,0 +1,73 @@
+package limiter
+
+import (
+	"context"
+	"time"
+)
+
+// waiter is a Throttle waitN is working with.
+type waiter interface {
+	Throttle
+	// grant checks n the way FillUp does, but does not report the stats and the events.
+	grant(n int64) int64
+	// record reports a request of n and an amount granted to the stats.
+	record(n, granted int64)
+	// throttle reports a time spent waiting to the stats.
+	throttle(d time.Duration)
+	// delay returns a time to wait until n could be granted.
+	delay(n int64) time.Duration
+}
+
+// waitN is a WaitN of the Limiter, Joint and Composite.
+// The request is counted once, the grants retried after the waits are not counted as the requests again.
+func waitN(ctx context.Context, w waiter, n int64) (int64, error) {
+	if err := ctx.Err(); err != nil || n <= 0 {
+		return w.FillUp(minInt64(n, 0)), err
+	}
+
+	granted := w.grant(n)
+	w.record(n, granted)
+
+	if granted > 0 {
+		if granted < n {
+			w.Report(Event{Kind: EventThrottled, Requested: n, Granted: granted})
+		}
+		return granted, nil
+	}
+
+	if left, _ := w.QuotaLeft(); left <= 0 {
+		return 0, ErrQuotaExhausted
+	}
+
+	clock := w.Clock()
+	startTime := clock.Now()
+
+	defer func() {
+		w.throttle(clock.Now().Sub(startTime))
+	}()
+
+	for {
+		timer := clock.NewTimer(w.delay(1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C():
+		}
+
+		if granted := w.grant(n); granted > 0 {
+			w.record(0, granted)
+			w.Report(Event{
+				Kind:      EventThrottled,
+				Requested: n,
+				Granted:   granted,
+				Waited:    clock.Now().Sub(startTime),
+			})
+			return granted, nil
+		}
+
+		if left, _ := w.QuotaLeft(); left <= 0 {
+			return 0, ErrQuotaExhausted
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Package metrics exposes the Controllers statistics in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/onokonem/go-throttledio/limiter"
+	"github.com/onokonem/go-throttledio/netlisten"
+)
+
+// Directions used for the Listener Controllers.
+const (
+	DirectionRead  = "read"
+	DirectionWrite = "write"
+)
+
+// contentType is the Prometheus text exposition format content type.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type key struct {
+	name      string
+	direction string
+}
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func(c *limiter.Controller, s limiter.Stats) float64
+}
+
+var metrics = []metric{ // nolint: gochecknoglobals
+	{
+		name:  "throttledio_granted_total",
+		help:  "Total amount granted.",
+		kind:  "counter",
+		value: func(_ *limiter.Controller, s limiter.Stats) float64 { return float64(s.Granted) },
+	},
+	{
+		name:  "throttledio_requested_total",
+		help:  "Total amount requested.",
+		kind:  "counter",
+		value: func(_ *limiter.Controller, s limiter.Stats) float64 { return float64(s.Requested) },
+	},
+	{
+		name:  "throttledio_denials_total",
+		help:  "Total number of requests got nothing at once.",
+		kind:  "counter",
+		value: func(_ *limiter.Controller, s limiter.Stats) float64 { return float64(s.Denials) },
+	},
+	{
+		name:  "throttledio_throttled_seconds_total",
+		help:  "Total time spent waiting for the grants.",
+		kind:  "counter",
+		value: func(_ *limiter.Controller, s limiter.Stats) float64 { return s.Throttled.Seconds() },
+	},
+	{
+		name:  "throttledio_rate",
+		help:  "Amount granted per second for the last interval.",
+		kind:  "gauge",
+		value: func(_ *limiter.Controller, s limiter.Stats) float64 { return s.Rate },
+	},
+	{
+		name:  "throttledio_common_limit",
+		help:  "Limit common for all the Limiters, per second.",
+		kind:  "gauge",
+		value: func(c *limiter.Controller, _ limiter.Stats) float64 { return limit(c.CommonCPS()) },
+	},
+	{
+		name:  "throttledio_per_child_limit",
+		help:  "Default limit for each Limiter, per second.",
+		kind:  "gauge",
+		value: func(c *limiter.Controller, _ limiter.Stats) float64 { return limit(c.PerChildCPS()) },
+	},
+	{
+		name:  "throttledio_limiters",
+		help:  "Number of Limiters not released and used for the last interval.",
+		kind:  "gauge",
+		value: func(c *limiter.Controller, _ limiter.Stats) float64 { return float64(len(c.Limiters())) },
+	},
+}
+
+type limiterMetric struct {
+	name  string
+	help  string
+	value func(s limiter.Stats) float64
+}
+
+var limiterMetrics = []limiterMetric{ // nolint: gochecknoglobals
+	{
+		name:  "throttledio_limiter_granted_total",
+		help:  "Total amount granted to the Limiters named.",
+		value: func(s limiter.Stats) float64 { return float64(s.Granted) },
+	},
+	{
+		name:  "throttledio_limiter_requested_total",
+		help:  "Total amount requested by the Limiters named.",
+		value: func(s limiter.Stats) float64 { return float64(s.Requested) },
+	},
+	{
+		name:  "throttledio_limiter_denials_total",
+		help:  "Total number of requests of the Limiters named got nothing at once.",
+		value: func(s limiter.Stats) float64 { return float64(s.Denials) },
+	},
+}
+
+// Collector is a set of Controllers to be exposed.
+// Each Controller is labeled by a name and a direction,
+// the statistics of all the Controller Limiters are exposed together.
+// The Limiters named with SetName are exposed on their own as well, labeled by the name in addition,
+// the ones with the same name are summed up. The unnamed ones are not, so the connections do not blow the cardinality.
+// The named totals are taken from limiter.Controller.NamedStats, so they do not go back once the Limiters are released.
+// Limiters are listed by limiter.Controller.Limiters, so the ones idle for the interval are not counted.
+type Collector struct {
+	controllers map[key]*limiter.Controller
+	lock        sync.Mutex
+}
+
+var _ http.Handler = (*Collector)(nil)
+
+// NewCollector creates an empty Collector.
+func NewCollector() *Collector {
+	return &Collector{
+		controllers: make(map[key]*limiter.Controller),
+	}
+}
+
+// Register adds the Controller to be exposed, the one registered with the same name and direction is replaced.
+func (c *Collector) Register(name string, direction string, controller *limiter.Controller) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.controllers[key{name: name, direction: direction}] = controller
+}
+
+// RegisterListener adds the Listener read and write Controllers to be exposed.
+func (c *Collector) RegisterListener(name string, listener *netlisten.Listener) {
+	c.Register(name, DirectionRead, listener.ReadLimiter())
+	c.Register(name, DirectionWrite, listener.WriteLimiter())
+}
+
+// Unregister removes the Controller registered with the name and direction.
+func (c *Collector) Unregister(name string, direction string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.controllers, key{name: name, direction: direction})
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	type sample struct {
+		key        key
+		controller *limiter.Controller
+		stats      limiter.Stats
+		names      []string
+		limiters   map[string]limiter.Stats
+	}
+
+	c.lock.Lock()
+	samples := make([]sample, 0, len(c.controllers))
+	for k, controller := range c.controllers {
+		samples = append(samples, sample{key: k, controller: controller, stats: controller.Stats()})
+	}
+	c.lock.Unlock()
+
+	for i := range samples {
+		samples[i].names, samples[i].limiters = named(samples[i].controller)
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].key.name != samples[j].key.name {
+			return samples[i].key.name < samples[j].key.name
+		}
+		return samples[i].key.direction < samples[j].key.direction
+	})
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	for _, m := range metrics {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range samples {
+			fmt.Fprintf(
+				cw,
+				"%s{controller=\"%s\",direction=\"%s\"} %s\n",
+				m.name,
+				escape(s.key.name),
+				escape(s.key.direction),
+				format(m.value(s.controller, s.stats)),
+			)
+		}
+	}
+
+	for _, m := range limiterMetrics {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, s := range samples {
+			for _, name := range s.names {
+				fmt.Fprintf(
+					cw,
+					"%s{controller=\"%s\",direction=\"%s\",limiter=\"%s\"} %s\n",
+					m.name,
+					escape(s.key.name),
+					escape(s.key.direction),
+					escape(name),
+					format(m.value(s.limiters[name])),
+				)
+			}
+		}
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+
+	return cw.n, cw.err
+}
+
+// named returns the sorted names and the stats of the Controller Limiters named, summed up by the name.
+func named(c *limiter.Controller) ([]string, map[string]limiter.Stats) {
+	stats := c.NamedStats()
+
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, stats
+}
+
+// ServeHTTP writes the metrics as a response.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	c.WriteTo(w) // nolint: errcheck
+}
+
+func limit(cps int64) float64 {
+	if cps == math.MaxInt64 {
+		return math.Inf(1)
+	}
+
+	return float64(cps)
+}
+
+func format(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`) // nolint: gochecknoglobals
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+
+	return n, err
+}
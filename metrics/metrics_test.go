@@ -0,0 +1,131 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock/clocktest"
+	"github.com/onokonem/go-throttledio/limiter"
+	"github.com/onokonem/go-throttledio/metrics"
+	"github.com/onokonem/go-throttledio/netlisten"
+)
+
+const (
+	interval = time.Second * 3
+	ticks    = 100
+)
+
+func TestWriteTo(t *testing.T) {
+	c := limiter.NewController(interval, ticks, 1, 0)
+	l := c.BornLimiter()
+	l.SetName("x")
+	l.FillUp(10)
+	l.FillUp(10)
+
+	// not exposed on its own
+	c.BornLimiter().FillUp(10)
+
+	collector := metrics.NewCollector()
+	collector.Register(`a"b`, metrics.DirectionRead, c)
+
+	b := new(bytes.Buffer)
+	n, err := collector.WriteTo(b)
+	if err != nil || n != int64(b.Len()) {
+		t.Errorf("expected (%d, nil), got (%d, %v)", b.Len(), n, err)
+	}
+
+	for _, expected := range []string{
+		"# TYPE throttledio_granted_total counter\n",
+		`throttledio_granted_total{controller="a\"b",direction="read"} 3` + "\n",
+		`throttledio_requested_total{controller="a\"b",direction="read"} 30` + "\n",
+		`throttledio_denials_total{controller="a\"b",direction="read"} 2` + "\n",
+		`throttledio_rate{controller="a\"b",direction="read"} 1` + "\n",
+		`throttledio_common_limit{controller="a\"b",direction="read"} 1` + "\n",
+		`throttledio_per_child_limit{controller="a\"b",direction="read"} +Inf` + "\n",
+		`throttledio_limiters{controller="a\"b",direction="read"} 2` + "\n",
+		"# TYPE throttledio_limiter_granted_total counter\n",
+		`throttledio_limiter_granted_total{controller="a\"b",direction="read",limiter="x"} 3` + "\n",
+		`throttledio_limiter_requested_total{controller="a\"b",direction="read",limiter="x"} 20` + "\n",
+		`throttledio_limiter_denials_total{controller="a\"b",direction="read",limiter="x"} 1` + "\n",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("expected %q in %q", expected, b.String())
+		}
+	}
+
+	collector.Unregister(`a"b`, metrics.DirectionRead)
+
+	b.Reset()
+	collector.WriteTo(b)
+	if strings.Contains(b.String(), "{") {
+		t.Errorf("expected no samples, got %q", b.String())
+	}
+}
+
+func TestNamedTotals(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m))
+
+	collector := metrics.NewCollector()
+	collector.Register("a", metrics.DirectionRead, c)
+
+	released, idle := c.BornLimiter(), c.BornLimiter()
+	released.SetName("tenant")
+	idle.SetName("tenant")
+	released.FillUp(499)
+	idle.FillUp(501)
+
+	expected := `throttledio_limiter_granted_total{controller="a",direction="read",limiter="tenant"} 1000` + "\n"
+
+	b := new(bytes.Buffer)
+	collector.WriteTo(b)
+	if !strings.Contains(b.String(), expected) {
+		t.Errorf("expected %q in %q", expected, b.String())
+	}
+
+	// one is gone, the other is dropped being idle for the interval
+	released.Release()
+	m.Advance(interval * 2)
+	c.BornLimiter()
+
+	if n := len(c.Limiters()); n != 1 {
+		t.Errorf("expected 1, got %d", n)
+	}
+
+	b.Reset()
+	collector.WriteTo(b)
+	if !strings.Contains(b.String(), expected) {
+		t.Errorf("expected %q in %q", expected, b.String())
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	collector := metrics.NewCollector()
+	collector.RegisterListener("server", netlisten.LimitListener(l, 0, 0).(*netlisten.Listener))
+
+	w := httptest.NewRecorder()
+	collector.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected text/plain, got %q", ct)
+	}
+
+	for _, expected := range []string{
+		`throttledio_limiters{controller="server",direction="read"} 0` + "\n",
+		`throttledio_limiters{controller="server",direction="write"} 0` + "\n",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("expected %q in %q", expected, w.Body.String())
+		}
+	}
+}
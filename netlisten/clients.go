@@ -0,0 +1,138 @@
+package netlisten
+
+import (
+	"net"
+	"sync"
+
+	"github.com/onokonem/go-throttledio/limiter"
+)
+
+// prefix masks the remote IPs to group the connections by.
+type prefix struct {
+	ipv4Mask net.IPMask
+	ipv6Mask net.IPMask
+}
+
+func newPrefix(ipv4Prefix int, ipv6Prefix int) prefix {
+	return prefix{
+		ipv4Mask: net.CIDRMask(ipv4Prefix, 8*net.IPv4len),
+		ipv6Mask: net.CIDRMask(ipv6Prefix, 8*net.IPv6len),
+	}
+}
+
+// key returns the remote IP prefix, empty for the addresses with no IP.
+func (p prefix) key(addr net.Addr) string {
+	var ip net.IP
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(p.ipv4Mask), Mask: p.ipv4Mask}).String()
+	}
+
+	if ip16 := ip.To16(); ip16 != nil {
+		return (&net.IPNet{IP: ip16.Mask(p.ipv6Mask), Mask: p.ipv6Mask}).String()
+	}
+
+	return ""
+}
+
+// clients groups the connections by the remote IP prefix,
+// each group has a pair of Controllers nested into the Listener ones.
+type clients struct {
+	readCPS  int64
+	writeCPS int64
+	groups   map[clientKey]*client
+	lock     sync.Mutex
+}
+
+// clientKey is the remote IP prefix and the Controllers the group is nested into,
+// as a Classifier could pick different ones for the same client.
+type clientKey struct {
+	prefix       string
+	readLimiter  *limiter.Controller
+	writeLimiter *limiter.Controller
+}
+
+type client struct {
+	readLimiter  *limiter.Controller
+	writeLimiter *limiter.Controller
+	conns        int
+}
+
+func newClients(readCPS int64, writeCPS int64) *clients {
+	return &clients{
+		readCPS:  readCPS,
+		writeCPS: writeCPS,
+		groups:   make(map[clientKey]*client),
+	}
+}
+
+// acquire returns the group for the key, a new one is created nested into the key Controllers.
+func (c *clients) acquire(key clientKey) *client {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	g, ok := c.groups[key]
+	if !ok {
+		g = &client{
+			readLimiter:  key.readLimiter.BornController(c.readCPS, 0),
+			writeLimiter: key.writeLimiter.BornController(c.writeCPS, 0),
+		}
+		c.groups[key] = g
+	}
+
+	g.conns++
+
+	return g
+}
+
+// release forgets the group in case there are no connections left.
+func (c *clients) release(key clientKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	g, ok := c.groups[key]
+	if !ok {
+		return
+	}
+
+	if g.conns--; g.conns > 0 {
+		return
+	}
+
+	g.readLimiter.Release()
+	g.writeLimiter.Release()
+	delete(c.groups, key)
+}
+
+func (c *clients) setCPS(readCPS int64, writeCPS int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readCPS, c.writeCPS = readCPS, writeCPS
+
+	for _, g := range c.groups {
+		g.readLimiter.SetCommonCPS(readCPS)
+		g.writeLimiter.SetCommonCPS(writeCPS)
+	}
+}
+
+func (c *clients) controllers(key clientKey) (*limiter.Controller, *limiter.Controller) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	g, ok := c.groups[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return g.readLimiter, g.writeLimiter
+}
@@ -1,9 +1,12 @@
 package netlisten
 
 import (
+	"context"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/onokonem/go-throttledio/clock"
 	"github.com/onokonem/go-throttledio/limiter"
 	"github.com/onokonem/go-throttledio/readwrite"
 )
@@ -11,20 +14,198 @@ import (
 // Conn is a net.Conn implementation powered with throttling.
 type Conn struct {
 	net.Conn
-	readLimiter  *limiter.Limiter
-	writeLimiter *limiter.Limiter
-	w            *readwrite.Writer
-	r            *readwrite.Reader
+	readLimiter   *limiter.Limiter
+	writeLimiter  *limiter.Limiter
+	budget        *limiter.Limiter
+	readThrottle  limiter.Throttle
+	writeThrottle limiter.Throttle
+	w             *readwrite.Writer
+	r             *readwrite.Reader
+	release       func()
+	releasePicked func()
+	pick          func()
+	pickOnce      sync.Once
+	picked        bool
+	pending       []func() // to be called once the limiters are picked
+	lock          sync.Mutex
+	closeOnce     sync.Once
+}
+
+// newConn creates a Conn, the budget one is applied to both directions, if not nil.
+func newConn(
+	conn net.Conn,
+	readLimiter *limiter.Limiter,
+	writeLimiter *limiter.Limiter,
+	budget *limiter.Controller,
+	release func(),
+) *Conn {
+	c := &Conn{
+		Conn:    conn,
+		release: release,
+	}
+
+	c.setLimiters(readLimiter, writeLimiter, budget, nil)
+	c.r = readwrite.NewReader(conn, c.readThrottle, false)
+	c.w = readwrite.NewWriter(conn, c.writeThrottle, false)
+
+	return c
+}
+
+// newClassifiedConn creates a Conn getting the limiters from the Controllers picked on the first Read or Write,
+// so the connection is not read within Accept. releasePicked is called on Close in case pick was called.
+func newClassifiedConn(
+	conn *PeekConn,
+	clock clock.Clock,
+	budget *limiter.Controller,
+	release func(),
+	pick func() (readLimiter *limiter.Controller, writeLimiter *limiter.Controller, releasePicked func()),
+) *Conn {
+	c := &Conn{
+		Conn:    conn,
+		release: release,
+	}
+
+	c.pick = func() {
+		r, w, releasePicked := pick()
+		c.setLimiters(r.BornLimiter(), w.BornLimiter(), budget, releasePicked)
+	}
+
+	c.r = readwrite.NewReader(conn, pickedThrottle{conn: c, clock: clock}, false)
+	c.w = readwrite.NewWriter(conn, pickedThrottle{conn: c, clock: clock, write: true}, false)
+
+	return c
+}
+
+// setLimiters sets the limiters picked and calls the pending calls.
+func (c *Conn) setLimiters(
+	readLimiter *limiter.Limiter,
+	writeLimiter *limiter.Limiter,
+	budget *limiter.Controller,
+	releasePicked func(),
+) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readLimiter, c.writeLimiter = readLimiter, writeLimiter
+	c.readThrottle, c.writeThrottle = readLimiter, writeLimiter
+	c.releasePicked = releasePicked
+
+	if budget != nil {
+		c.budget = budget.BornLimiter()
+		c.readThrottle = limiter.NewJoint(readLimiter, c.budget)
+		c.writeThrottle = limiter.NewJoint(writeLimiter, c.budget)
+	}
+
+	c.picked = true
+	for _, f := range c.pending {
+		f()
+	}
+	c.pending = nil
+}
+
+// limiters calls f once the limiters are picked, at once in case they are picked already.
+func (c *Conn) limiters(f func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.picked {
+		c.pending = append(c.pending, f)
+		return
+	}
+
+	f()
+}
+
+// throttle returns the read or write Throttle, the limiters are picked first if not yet.
+func (c *Conn) throttle(write bool) limiter.Throttle {
+	c.pickOnce.Do(func() {
+		if c.pick != nil {
+			c.pick()
+		}
+	})
+
+	if write {
+		return c.writeThrottle
+	}
+
+	return c.readThrottle
+}
+
+// pickedThrottle is a Throttle of a Conn direction, the Conn limiters are picked on its first use.
+type pickedThrottle struct {
+	conn  *Conn
+	clock clock.Clock
+	write bool
+}
+
+func (t pickedThrottle) FillUp(n int64) int64 {
+	return t.conn.throttle(t.write).FillUp(n)
+}
+
+func (t pickedThrottle) WaitN(ctx context.Context, n int64) (int64, error) {
+	return t.conn.throttle(t.write).WaitN(ctx, n)
+}
+
+func (t pickedThrottle) QuotaLeft() (int64, time.Time) {
+	return t.conn.throttle(t.write).QuotaLeft()
+}
+
+func (t pickedThrottle) Clock() clock.Clock {
+	return t.clock
+}
+
+func (t pickedThrottle) Report(e limiter.Event) {
+	t.conn.throttle(t.write).Report(e)
+}
+
+// Classifier picks the read and write Controllers for the connection accepted or dialed,
+// e.g. by the local port, the remote address, or the first bytes peeked.
+// nil means the Listener or Dialer one.
+// Classifier of a Listener is called on the first Read or Write of the connection, not within Accept,
+// so a client sending nothing does not stall the others. Peek blocks until the deadlines set on the connection,
+// and a Write made first is waiting for it as well, so the protocols the server speaks first are to be classified
+// without peeking.
+// Classifier of a Dialer is called within Dial, Peek is unblocked once the dial context is done.
+type Classifier func(conn *PeekConn) (readLimiter *limiter.Controller, writeLimiter *limiter.Controller)
+
+// classify returns the Controllers picked by the classifier, the ones provided in case it picks nil.
+func classify(
+	classifier Classifier,
+	conn *PeekConn,
+	readLimiter *limiter.Controller,
+	writeLimiter *limiter.Controller,
+) (*limiter.Controller, *limiter.Controller) {
+	r, w := classifier(conn)
+	if r == nil {
+		r = readLimiter
+	}
+	if w == nil {
+		w = writeLimiter
+	}
+
+	return r, w
 }
 
 // SetReadCPS sets the read limit.
+// It is applied once the Classifier is called, in case it was not yet.
 func (c *Conn) SetReadCPS(cps int64) {
-	c.readLimiter.SetCPS(cps)
+	c.limiters(func() { c.readLimiter.SetCPS(cps) })
 }
 
 // SetWriteCPS sets the write limit.
+// It is applied once the Classifier is called, in case it was not yet.
 func (c *Conn) SetWriteCPS(cps int64) {
-	c.writeLimiter.SetCPS(cps)
+	c.limiters(func() { c.writeLimiter.SetCPS(cps) })
+}
+
+// SetBudgetCPS sets the limit common for both directions.
+// Does nothing in case there is no budget set with WithBudget or WithDialBudget.
+func (c *Conn) SetBudgetCPS(cps int64) {
+	c.limiters(func() {
+		if c.budget != nil {
+			c.budget.SetCPS(cps)
+		}
+	})
 }
 
 // Read reads data from the connection.
@@ -41,6 +222,27 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 	return c.w.Write(b)
 }
 
+// Close closes the connection and releases the limiters.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.limiters(func() {
+			c.readLimiter.Release()
+			c.writeLimiter.Release()
+			if c.budget != nil {
+				c.budget.Release()
+			}
+			if c.releasePicked != nil {
+				c.releasePicked()
+			}
+		})
+		if c.release != nil {
+			c.release()
+		}
+	})
+
+	return c.Conn.Close()
+}
+
 // SetDeadline sets the read and write deadlines associated
 // with the connection. It is equivalent to calling both
 // SetReadDeadline and SetWriteDeadline.
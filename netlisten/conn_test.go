@@ -1,52 +1,55 @@
 package netlisten_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/onokonem/go-throttledio/clock/clocktest"
 	"github.com/onokonem/go-throttledio/limiter"
 	"github.com/onokonem/go-throttledio/netlisten"
 	"github.com/onokonem/go-throttledio/readwrite"
 )
 
 func TestSetWriteCPS(t *testing.T) {
-	interval := time.Second * 3
+	m := clocktest.NewManual(epoch)
 
 	l := listen()
+	defer l.Close()
 
 	// just to increase the cover
 	l.(*netlisten.Listener).WriteLimiter()
 
 	reqSpeed := int64(100000)
 
-	go func() {
-		d := netlisten.NewDialer(
-			net.Dialer{},
-			limiter.NewController(Interval, Ticks, 0, 0),
-			limiter.NewController(Interval, Ticks, 0, 0),
-		)
-		conn, err := d.Dial(l.Addr().Network(), l.Addr().String())
-		if err != nil {
-			panic(err)
-		}
-		conn.(*netlisten.Conn).SetWriteCPS(reqSpeed)
-		io.Copy(conn, &noOpReader{})
-	}()
+	d := netlisten.NewDialer(
+		net.Dialer{},
+		limiter.NewController(Interval, Ticks, 0, 0, limiter.WithClock(m)),
+		limiter.NewController(Interval, Ticks, 0, 0, limiter.WithClock(m)),
+	)
+	conn, err := d.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
 
 	server := accept(l, new(int64))
+	defer server.conn.Close()
 	go server.read()
 
-	startTime := time.Now()
-	time.Sleep(interval * 5 / 2)
+	conn.(*netlisten.Conn).SetWriteCPS(reqSpeed)
+	client := &connWriter{conn: conn, total: new(int64)}
+	go client.write()
 
-	curTime := time.Now()
-	speed := float64(atomic.LoadInt64(server.total)) / curTime.Sub(startTime).Seconds()
+	spent := run(m, 1, TestDuration).Seconds()
+	speed := float64(atomic.LoadInt64(client.total)) / spent
 
 	deviation := (float64(reqSpeed) - speed) / float64(reqSpeed)
 
@@ -155,6 +158,550 @@ func TestDeadline(t *testing.T) {
 	if r := float64(spent-timeout) / float64(timeout); math.Abs(r) > 0.01 {
 		t.Errorf("expected %v, got %v (%f)", timeout, spent, r)
 	}
+
+	// keep the connection referenced, the server side panics on it closed
+	conn.SetDeadline(time.Time{})
+	go io.Copy(ioutil.Discard, conn)
+}
+
+func TestClose(t *testing.T) {
+	l := listen()
+
+	go func() {
+		conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			panic(err)
+		}
+		conn.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		panic(err)
+	}
+
+	readLimiter := l.(*netlisten.Listener).ReadLimiter()
+	if n := len(readLimiter.Limiters()); n != 1 {
+		t.Errorf("expected 1, got %d", n)
+	}
+
+	conn.Close()
+
+	if n := len(readLimiter.Limiters()); n != 0 {
+		t.Errorf("expected 0, got %d", n)
+	}
+}
+
+func TestPerClient(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+
+	l := netlisten.NewListener(
+		ln,
+		limiter.NewController(Interval, Ticks, 0, 0),
+		limiter.NewController(Interval, Ticks, 0, 0),
+		netlisten.WithPerClient(24, 64, 1000, 0),
+	)
+
+	conns := make([]net.Conn, 3)
+	for i := range conns {
+		go func() {
+			if _, err := net.Dial(l.Addr().Network(), l.Addr().String()); err != nil {
+				panic(err)
+			}
+		}()
+
+		if conns[i], err = l.Accept(); err != nil {
+			panic(err)
+		}
+	}
+
+	readLimiter, writeLimiter := l.ClientLimiters(conns[0].RemoteAddr())
+	if readLimiter == nil || writeLimiter == nil {
+		t.Fatalf("expected the client limiters")
+	}
+
+	if readLimiter.Parent() != l.ReadLimiter() || writeLimiter.Parent() != l.WriteLimiter() {
+		t.Errorf("expected the client limiters nested into the listener ones")
+	}
+
+	if n := len(readLimiter.Limiters()); n != 3 {
+		t.Errorf("expected 3, got %d", n)
+	}
+
+	if actual := readLimiter.CommonCPS(); actual != 1000 {
+		t.Errorf("expected 1000, got %d", actual)
+	}
+
+	l.SetPerClientCPS(2000, 0)
+	if actual := readLimiter.CommonCPS(); actual != 2000 {
+		t.Errorf("expected 2000, got %d", actual)
+	}
+
+	// another address within the same /24
+	if r, _ := l.ClientLimiters(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 200)}); r != readLimiter {
+		t.Errorf("expected the same client limiters")
+	}
+
+	if r, _ := l.ClientLimiters(&net.TCPAddr{IP: net.IPv4(127, 0, 1, 1)}); r != nil {
+		t.Errorf("expected no client limiters, got %v", r)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	conns[0].Close()
+
+	if r, w := l.ClientLimiters(conns[0].RemoteAddr()); r != nil || w != nil {
+		t.Errorf("expected no client limiters, got %v, %v", r, w)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+
+	l := netlisten.NewListener(
+		ln,
+		limiter.NewController(Interval, Ticks, 0, 0),
+		limiter.NewController(Interval, Ticks, 0, 0),
+		netlisten.WithMaxConns(2, 0, netlisten.Block),
+	)
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	clients := make([]net.Conn, 3)
+	for i := range clients {
+		if clients[i], err = net.Dial(l.Addr().Network(), l.Addr().String()); err != nil {
+			panic(err)
+		}
+	}
+
+	first := <-accepted
+	<-accepted
+
+	select {
+	case <-accepted:
+		t.Errorf("expected Accept blocked")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	first.Close()
+
+	if conn := <-accepted; conn == nil {
+		t.Errorf("expected the connection accepted")
+	}
+
+	l.Close()
+
+	if conn := <-accepted; conn != nil {
+		t.Errorf("expected Accept failed, got %v", conn)
+	}
+}
+
+func TestMaxConnsPerClient(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+
+	l := netlisten.NewListener(
+		ln,
+		limiter.NewController(Interval, Ticks, 0, 0),
+		limiter.NewController(Interval, Ticks, 0, 0),
+		netlisten.WithMaxConns(0, 1, netlisten.Reject),
+	)
+	defer l.Close()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			panic(err)
+		}
+		return conn
+	}
+
+	go dial()
+
+	first, err := l.Accept()
+	if err != nil {
+		panic(err)
+	}
+
+	rejected := dial()
+	go func() {
+		// the one over the limit is closed, and the next one is accepted
+		if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected %v, got %v", io.EOF, err)
+		}
+		first.Close()
+		dial()
+	}()
+
+	if _, err := l.Accept(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestAcceptRate(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+
+	l := netlisten.NewListener(
+		ln,
+		limiter.NewController(Interval, Ticks, 0, 0),
+		limiter.NewController(Interval, Ticks, 0, 0),
+		netlisten.WithAcceptRate(2, 0, netlisten.Block),
+		netlisten.WithMaxConns(0, 0, netlisten.Reject),
+	)
+	defer l.Close()
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			if _, err := net.Dial(l.Addr().Network(), l.Addr().String()); err != nil {
+				panic(err)
+			}
+		}
+	}()
+
+	startTime := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := l.Accept(); err != nil {
+			panic(err)
+		}
+	}
+
+	if spent := time.Since(startTime); spent < time.Second/2 {
+		t.Errorf("expected the third Accept delayed, spent %v", spent)
+	}
+
+	expected := netlisten.AcceptStats{Accepted: 3}
+	if actual := l.AcceptStats(); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestAcceptRatePerClient(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+
+	l := netlisten.NewListener(
+		ln,
+		limiter.NewController(Interval, Ticks, 0, 0),
+		limiter.NewController(Interval, Ticks, 0, 0),
+		netlisten.WithAcceptRate(0, 2, netlisten.Block),
+	)
+	defer l.Close()
+
+	other := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+
+	go func() {
+		// the third one is over the limit, while the other client is not affected
+		for _, local := range []*net.TCPAddr{nil, nil, nil, other} {
+			d := net.Dialer{}
+			if local != nil {
+				d.LocalAddr = local
+			}
+
+			if _, err := d.Dial(l.Addr().Network(), l.Addr().String()); err != nil {
+				panic(err)
+			}
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			panic(err)
+		}
+
+		if conn.RemoteAddr().(*net.TCPAddr).IP.Equal(other.IP) {
+			break
+		}
+	}
+
+	expected := netlisten.AcceptStats{Accepted: 3, RejectedRate: 1}
+	if actual := l.AcceptStats(); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestClassifier(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+
+	var (
+		slow     = limiter.NewController(Interval, Ticks, 0, 0)
+		fast     = limiter.NewController(Interval, Ticks, 0, 0)
+		dialFast = limiter.NewController(Interval, Ticks, 0, 0)
+	)
+
+	l := netlisten.NewListener(
+		ln,
+		slow,
+		limiter.NewController(Interval, Ticks, 0, 0),
+		netlisten.WithClassifier(func(conn *netlisten.PeekConn) (*limiter.Controller, *limiter.Controller) {
+			if b, err := conn.Peek(4); err == nil && string(b) == "FAST" {
+				return fast, nil
+			}
+			return nil, nil
+		}),
+	)
+	defer l.Close()
+
+	d := netlisten.NewDialer(
+		net.Dialer{},
+		limiter.NewController(Interval, Ticks, 0, 0),
+		limiter.NewController(Interval, Ticks, 0, 0),
+		netlisten.WithDialClassifier(func(conn *netlisten.PeekConn) (*limiter.Controller, *limiter.Controller) {
+			return nil, dialFast
+		}),
+	)
+
+	for _, msg := range []string{"FAST", "SLOW"} {
+		go func(msg string) {
+			conn, err := d.Dial(l.Addr().Network(), l.Addr().String())
+			if err != nil {
+				panic(err)
+			}
+			conn.Write([]byte(msg))
+		}(msg)
+
+		conn, err := l.Accept()
+		if err != nil {
+			panic(err)
+		}
+
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != msg {
+			t.Errorf("expected %s, got %s (%v)", msg, b, err)
+		}
+	}
+
+	for i, c := range []struct {
+		controller *limiter.Controller
+		expected   int
+	}{
+		{fast, 1},
+		{slow, 1},
+		{dialFast, 2},
+	} {
+		if n := len(c.controller.Limiters()); n != c.expected {
+			t.Errorf("%d: expected %d, got %d", i, c.expected, n)
+		}
+	}
+}
+
+func TestClassifierSilentClient(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+
+	fast := limiter.NewController(Interval, Ticks, 0, 0)
+
+	l := netlisten.NewListener(
+		ln,
+		limiter.NewController(Interval, Ticks, 0, 0),
+		limiter.NewController(Interval, Ticks, 0, 0),
+		netlisten.WithClassifier(func(conn *netlisten.PeekConn) (*limiter.Controller, *limiter.Controller) {
+			if b, err := conn.Peek(4); err == nil && string(b) == "FAST" {
+				return fast, nil
+			}
+			return nil, nil
+		}),
+	)
+	defer l.Close()
+
+	silent, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	defer silent.Close()
+
+	talking, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	defer talking.Close()
+
+	talking.Write([]byte("FAST"))
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				panic(err)
+			}
+			accepted <- conn
+		}
+	}()
+
+	// the silent client does not stall Accept
+	for i := 0; i < 2; i++ {
+		select {
+		case conn := <-accepted:
+			defer conn.Close()
+
+			if conn.RemoteAddr().String() != talking.LocalAddr().String() {
+				continue
+			}
+
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(conn, b); err != nil || string(b) != "FAST" {
+				t.Errorf("expected FAST, got %s (%v)", b, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("connection %d is not accepted", i)
+		}
+	}
+
+	if n := len(fast.Limiters()); n != 1 {
+		t.Errorf("expected 1, got %d", n)
+	}
+}
+
+func TestDialClassifierContext(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+	defer ln.Close()
+
+	// the server sends nothing
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := netlisten.NewDialer(
+		net.Dialer{},
+		limiter.NewController(Interval, Ticks, 0, 0),
+		limiter.NewController(Interval, Ticks, 0, 0),
+		netlisten.WithDialClassifier(func(conn *netlisten.PeekConn) (*limiter.Controller, *limiter.Controller) {
+			conn.Peek(1)
+			return nil, nil
+		}),
+	)
+
+	for _, c := range []struct {
+		ctx      func() (context.Context, context.CancelFunc)
+		expected error
+	}{
+		{
+			func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Millisecond*100)
+			},
+			context.DeadlineExceeded,
+		},
+		{
+			func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(time.Millisecond*100, cancel)
+				return ctx, cancel
+			},
+			context.Canceled,
+		},
+	} {
+		ctx, cancel := c.ctx()
+		defer cancel()
+
+		done := make(chan error)
+		go func() {
+			_, err := d.DialContext(ctx, ln.Addr().Network(), ln.Addr().String())
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %v, the dial is blocked", c.expected)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+
+	budget := limiter.NewController(Interval, Ticks, 0, 0)
+
+	l := netlisten.NewListener(
+		ln,
+		limiter.NewController(Interval, Ticks, 0, 0),
+		limiter.NewController(Interval, Ticks, 0, 0),
+		netlisten.WithBudget(budget),
+	)
+	defer l.Close()
+
+	if l.BudgetLimiter() != budget {
+		t.Errorf("expected the budget Controller")
+	}
+
+	go func() {
+		conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			panic(err)
+		}
+		conn.Write([]byte("ping"))
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		panic(err)
+	}
+
+	conn.(*netlisten.Conn).SetBudgetCPS(1000)
+
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	limiters := budget.Limiters()
+	if len(limiters) != 1 {
+		t.Fatalf("expected 1, got %d", len(limiters))
+	}
+
+	if actual := limiters[0].Stats().Granted; actual != 4 {
+		t.Errorf("expected 4, got %d", actual)
+	}
+
+	conn.Close()
+
+	if n := len(budget.Limiters()); n != 0 {
+		t.Errorf("expected 0, got %d", n)
+	}
 }
 
 type noOpReader struct{}
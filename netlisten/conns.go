@@ -0,0 +1,98 @@
+package netlisten
+
+import (
+	"sync"
+)
+
+// Mode is a way the Listener treats the connections over a limit.
+type Mode int
+
+// Modes
+const (
+	// Block makes Accept wait until the next connection fits the limit.
+	Block Mode = iota
+	// Reject makes the Listener close the connection over the limit at once and wait for the next one.
+	Reject
+)
+
+// conns counts the open connections, in total and per remote IP prefix.
+type conns struct {
+	global    int
+	perClient int
+	mode      Mode
+	open      int
+	clients   map[string]int
+	freed     chan struct{} // closed and replaced when a connection is released
+	lock      sync.Mutex
+}
+
+func newConns(global int, perClient int, mode Mode) *conns {
+	return &conns{
+		global:    global,
+		perClient: perClient,
+		mode:      mode,
+		clients:   make(map[string]int),
+		freed:     make(chan struct{}),
+	}
+}
+
+// reserve takes a global slot, waiting for it in Block mode until done is closed.
+// Returns false in case there is no slot.
+func (c *conns) reserve(done <-chan struct{}) bool {
+	for {
+		c.lock.Lock()
+		if c.global <= 0 || c.open < c.global {
+			c.open++
+			c.lock.Unlock()
+			return true
+		}
+		freed := c.freed
+		c.lock.Unlock()
+
+		if c.mode == Reject {
+			return false
+		}
+
+		select {
+		case <-freed:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// acquire takes a slot of the client, the global one is to be reserved already.
+// Returns false in case there is no slot.
+func (c *conns) acquire(key string) bool {
+	if key == "" || c.perClient <= 0 {
+		return true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.clients[key] >= c.perClient {
+		return false
+	}
+
+	c.clients[key]++
+
+	return true
+}
+
+// release frees the global slot and the client one, if taken.
+func (c *conns) release(key string, client bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.open--
+
+	if client && key != "" && c.perClient > 0 {
+		if c.clients[key]--; c.clients[key] <= 0 {
+			delete(c.clients, key)
+		}
+	}
+
+	close(c.freed)
+	c.freed = make(chan struct{})
+}
@@ -3,9 +3,9 @@ package netlisten
 import (
 	"context"
 	"net"
+	"time"
 
 	"github.com/onokonem/go-throttledio/limiter"
-	"github.com/onokonem/go-throttledio/readwrite"
 )
 
 // Dialer is a net.Dialer wrapper
@@ -13,19 +13,47 @@ type Dialer struct {
 	net.Dialer
 	readLimiter  *limiter.Controller
 	writeLimiter *limiter.Controller
+	classifier   Classifier
+	budget       *limiter.Controller
+}
+
+// DialerOption is a Dialer option.
+type DialerOption func(*Dialer)
+
+// WithDialClassifier sets a Classifier picking the Controllers for each connection dialed.
+func WithDialClassifier(classifier Classifier) DialerOption {
+	return func(d *Dialer) {
+		d.classifier = classifier
+	}
+}
+
+// WithDialBudget sets a Controller limiting both directions together,
+// each connection gets a Limiter born by it in addition to the read and write ones.
+func WithDialBudget(budget *limiter.Controller) DialerOption {
+	return func(d *Dialer) {
+		d.budget = budget
+	}
 }
 
 // NewDialer creates a Dialer
+// opts are applied in order provided.
 func NewDialer(
 	dialer net.Dialer,
 	readLimiter *limiter.Controller,
 	writeLimiter *limiter.Controller,
+	opts ...DialerOption,
 ) *Dialer {
-	return &Dialer{
+	d := &Dialer{
 		Dialer:       dialer,
 		readLimiter:  readLimiter,
 		writeLimiter: writeLimiter,
 	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
 }
 
 // Dial is a wrapper around DialContext().
@@ -42,17 +70,59 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (*Con
 		return nil, err
 	}
 
-	var (
-		readLimiter  = d.readLimiter.BornLimiter()
-		writeLimiter = d.writeLimiter.BornLimiter()
-	)
+	readController, writeController := d.readLimiter, d.writeLimiter
+	if d.classifier != nil {
+		pc := NewPeekConn(conn)
+		if readController, writeController, err = d.classify(ctx, pc); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = pc
+	}
+
+	return newConn(conn, readController.BornLimiter(), writeController.BornLimiter(), d.budget, nil), nil
+}
+
+// aLongTimeAgo is a deadline unblocking the reads at once.
+var aLongTimeAgo = time.Unix(1, 0) // nolint: gochecknoglobals
+
+// classify calls the Classifier with ctx applied to the connection reads, so Peek is unblocked once ctx is done.
+// The read deadline is cleared afterwards, ctx.Err() is returned in case ctx is done or its deadline is passed.
+func (d *Dialer) classify(ctx context.Context, pc *PeekConn) (*limiter.Controller, *limiter.Controller, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.SetReadDeadline(deadline) // nolint: errcheck
+	}
+
+	stop := func() {}
+	if ctx.Done() != nil {
+		quit, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				pc.SetReadDeadline(aLongTimeAgo) // nolint: errcheck
+			case <-quit:
+			}
+		}()
+		stop = func() {
+			close(quit)
+			<-stopped
+		}
+	}
+
+	readController, writeController := classify(d.classifier, pc, d.readLimiter, d.writeLimiter)
+
+	// the deadline is not set after it is cleared
+	stop()
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// the read deadline could be reached a bit earlier than ctx is done
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return nil, nil, context.DeadlineExceeded
+	}
 
-	return &Conn{
-			Conn:         conn,
-			readLimiter:  readLimiter,
-			writeLimiter: writeLimiter,
-			r:            readwrite.NewReader(conn, readLimiter, false),
-			w:            readwrite.NewWriter(conn, writeLimiter, false),
-		},
-		nil
+	return readController, writeController, pc.SetReadDeadline(time.Time{})
 }
@@ -1,16 +1,17 @@
 package netlisten
 
 import (
+	"context"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/onokonem/go-throttledio/limiter"
-	"github.com/onokonem/go-throttledio/readwrite"
 )
 
 // LimitListener creates a Listener with the per-server and per-connection read limits provided.
 // write will be unlimited.
-// interval will be 10 seconds, divided to 100 ticks.
+// interval will be 10 seconds, divided to 100 ticks, could be changed with limiter.Controller.Reconfigure.
 func LimitListener(l net.Listener, globalLimit int, connectionLimit int) net.Listener {
 	return NewListener(
 		l,
@@ -24,41 +25,258 @@ type Listener struct {
 	net.Listener
 	readLimiter  *limiter.Controller
 	writeLimiter *limiter.Controller
+	prefix       prefix
+	classifier   Classifier
+	budget       *limiter.Controller
+	clients      *clients
+	conns        *conns
+	rate         *acceptRate
+	stats        acceptStats
+	ctx          context.Context
+	cancel       context.CancelFunc
+}
+
+// AcceptStats is a snapshot of the Listener accept counters.
+type AcceptStats struct {
+	// Accepted is a number of the connections returned by Accept.
+	Accepted int64
+	// RejectedConns is a number of the connections closed as over the WithMaxConns limits.
+	RejectedConns int64
+	// RejectedRate is a number of the connections closed as over the WithAcceptRate limits.
+	RejectedRate int64
+}
+
+type acceptStats struct {
+	accepted      int64
+	rejectedConns int64
+	rejectedRate  int64
+}
+
+// Option is a Listener option.
+type Option func(*Listener)
+
+// WithPerClient groups the connections by the remote IP,
+// so all the connections of one client share readCPS and writeCPS
+// in addition to the per-server and per-connection limits.
+// The IPs are masked with ipv4Prefix or ipv6Prefix bits, e.g. 24 or 64, 32 and 128 mean a single address.
+// Not positive readCPS or writeCPS means no limit.
+// Connections with no remote IP, e.g. unix socket ones, are not grouped.
+func WithPerClient(ipv4Prefix int, ipv6Prefix int, readCPS int64, writeCPS int64) Option {
+	return func(l *Listener) {
+		l.prefix = newPrefix(ipv4Prefix, ipv6Prefix)
+		l.clients = newClients(readCPS, writeCPS)
+	}
+}
+
+// WithMaxConns limits a number of the connections open simultaneously, globally and per client.
+// Clients are grouped by the remote IP prefix set by WithPerClient, a single address by default.
+// Not positive global or perClient means no limit.
+// mode is applied to the global limit only: Accept is blocked until some connection is closed,
+// or the excess connection is closed.
+// The connection over the per client limit is always closed, as the other clients are not to wait for it.
+func WithMaxConns(global int, perClient int, mode Mode) Option {
+	return func(l *Listener) {
+		l.conns = newConns(global, perClient, mode)
+	}
+}
+
+// WithAcceptRate limits a number of the connections accepted per second, globally and per client.
+// Clients are grouped by the remote IP prefix set by WithPerClient, a single address by default.
+// Not positive globalCPS or perClientCPS means no limit.
+// mode is applied to the global limit only: Accept is delayed, or the excess connection is closed.
+// The connection over the per client limit is always closed, as the other clients are not to wait for it.
+// The rate is measured with a Controller using the read one clock.
+func WithAcceptRate(globalCPS int64, perClientCPS int64, mode Mode) Option {
+	return func(l *Listener) {
+		l.rate = newAcceptRate(limiter.WithClock(l.readLimiter.Clock()), globalCPS, perClientCPS, mode)
+	}
+}
+
+// WithClassifier sets a Classifier picking the Controllers for each connection accepted.
+// Per client Controllers are nested into the ones picked.
+func WithClassifier(classifier Classifier) Option {
+	return func(l *Listener) {
+		l.classifier = classifier
+	}
+}
+
+// WithBudget sets a Controller limiting both directions together,
+// each connection gets a Limiter born by it in addition to the read and write ones.
+func WithBudget(budget *limiter.Controller) Option {
+	return func(l *Listener) {
+		l.budget = budget
+	}
 }
 
 // NewListener creates a Listener
+// opts are applied in order provided.
 func NewListener(
 	listener net.Listener,
 	readLimiter *limiter.Controller,
 	writeLimiter *limiter.Controller,
+	opts ...Option,
 ) *Listener {
-	return &Listener{
+	l := &Listener{
 		Listener:     listener,
 		readLimiter:  readLimiter,
 		writeLimiter: writeLimiter,
+		prefix:       newPrefix(8*net.IPv4len, 8*net.IPv6len),
+	}
+
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(l)
 	}
+
+	return l
 }
 
 // Accept waits for and returns the next connection to the listener.
+// The connections over the limits set by WithMaxConns and WithAcceptRate are closed silently,
+// see AcceptStats.
 func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.accept()
+		if err != nil || conn != nil {
+			return conn, err
+		}
+	}
+}
+
+// accept returns nil, nil in case the connection was rejected.
+func (l *Listener) accept() (net.Conn, error) {
+	var (
+		undo     []func() // to be done in case the connection is rejected
+		rejected *int64
+	)
+
+	// the limits checked before the connection is accepted, Block mode wait fails on the Listener closed only
+	if l.conns != nil {
+		if l.conns.reserve(l.ctx.Done()) {
+			undo = append(undo, func() { l.conns.release("", false) })
+		} else {
+			rejected = &l.stats.rejectedConns
+		}
+	}
+
+	if l.rate != nil && rejected == nil {
+		if l.rate.wait(l.ctx) {
+			undo = append(undo, l.rate.cancelWait)
+		} else {
+			rejected = &l.stats.rejectedRate
+		}
+	}
+
 	conn, err := l.Listener.Accept()
 	if err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
 		return nil, err
 	}
 
-	var (
-		readLimiter  = l.readLimiter.BornLimiter()
-		writeLimiter = l.writeLimiter.BornLimiter()
-	)
+	key := l.prefix.key(conn.RemoteAddr())
+
+	if l.rate != nil && rejected == nil {
+		if l.rate.allow(key) {
+			undo = append(undo, func() { l.rate.cancelAllow(key) })
+		} else {
+			rejected = &l.stats.rejectedRate
+		}
+	}
+
+	if l.conns != nil && rejected == nil && !l.conns.acquire(key) {
+		rejected = &l.stats.rejectedConns
+	}
+
+	if rejected != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		atomic.AddInt64(rejected, 1)
+		conn.Close()
+		return nil, nil
+	}
+
+	atomic.AddInt64(&l.stats.accepted, 1)
+
+	var release func()
 
-	return &Conn{
-			Conn:         conn,
-			readLimiter:  readLimiter,
-			writeLimiter: writeLimiter,
-			r:            readwrite.NewReader(conn, readLimiter, false),
-			w:            readwrite.NewWriter(conn, writeLimiter, false),
-		},
-		nil
+	if l.conns != nil {
+		release = func() { l.conns.release(key, true) }
+	}
+
+	if l.classifier == nil {
+		readController, writeController, releaseClient := l.client(key, l.readLimiter, l.writeLimiter)
+
+		return newConn(conn, readController.BornLimiter(), writeController.BornLimiter(), l.budget, func() {
+			releaseClient()
+			if release != nil {
+				release()
+			}
+		}), nil
+	}
+
+	pc := NewPeekConn(conn)
+
+	return newClassifiedConn(pc, l.readLimiter.Clock(), l.budget, release, func() (*limiter.Controller, *limiter.Controller, func()) {
+		readController, writeController := classify(l.classifier, pc, l.readLimiter, l.writeLimiter)
+		return l.client(key, readController, writeController)
+	}), nil
+}
+
+// client returns the Controllers of the client the connection belongs to, nested into the ones provided,
+// and a function releasing them. The ones provided are returned in case the connections are not grouped.
+func (l *Listener) client(
+	key string,
+	readController *limiter.Controller,
+	writeController *limiter.Controller,
+) (*limiter.Controller, *limiter.Controller, func()) {
+	if l.clients == nil || key == "" {
+		return readController, writeController, func() {}
+	}
+
+	ck := clientKey{prefix: key, readLimiter: readController, writeLimiter: writeController}
+	g := l.clients.acquire(ck)
+
+	return g.readLimiter, g.writeLimiter, func() { l.clients.release(ck) }
+}
+
+// Close closes the Listener, the blocked Accept calls return an error.
+func (l *Listener) Close() error {
+	err := l.Listener.Close()
+	l.cancel()
+
+	return err
+}
+
+// AcceptStats returns the accept counters.
+func (l *Listener) AcceptStats() AcceptStats {
+	return AcceptStats{
+		Accepted:      atomic.LoadInt64(&l.stats.accepted),
+		RejectedConns: atomic.LoadInt64(&l.stats.rejectedConns),
+		RejectedRate:  atomic.LoadInt64(&l.stats.rejectedRate),
+	}
+}
+
+// SetPerClientCPS changes the per-client limits, set with WithPerClient, for all the clients.
+// Does nothing in case the connections are not grouped.
+func (l *Listener) SetPerClientCPS(readCPS int64, writeCPS int64) {
+	if l.clients != nil {
+		l.clients.setCPS(readCPS, writeCPS)
+	}
+}
+
+// ClientLimiters returns the read and write Controllers shared by the connections from the address provided,
+// nil in case there are no such connections or they are not grouped.
+// Only the ones nested into the Listener Controllers are returned, not the ones picked by a Classifier.
+func (l *Listener) ClientLimiters(addr net.Addr) (*limiter.Controller, *limiter.Controller) {
+	if l.clients == nil {
+		return nil, nil
+	}
+
+	return l.clients.controllers(clientKey{prefix: l.prefix.key(addr), readLimiter: l.readLimiter, writeLimiter: l.writeLimiter})
 }
 
 // ReadLimiter returns a limiter for read.
@@ -66,6 +284,11 @@ func (l *Listener) ReadLimiter() *limiter.Controller {
 	return l.readLimiter
 }
 
+// BudgetLimiter returns a limiter for both directions, nil in case it is not set.
+func (l *Listener) BudgetLimiter() *limiter.Controller {
+	return l.budget
+}
+
 // WriteLimiter returns a limiter for write.
 func (l *Listener) WriteLimiter() *limiter.Controller {
 	return l.writeLimiter
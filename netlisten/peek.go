@@ -0,0 +1,37 @@
+package netlisten
+
+import (
+	"bufio"
+	"net"
+)
+
+// PeekConn is a net.Conn able to look at the incoming bytes without consuming them,
+// e.g. to tell the protocol spoken by a Classifier.
+type PeekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewPeekConn wraps the connection, nothing is buffered until Peek is called.
+func NewPeekConn(conn net.Conn) *PeekConn {
+	return &PeekConn{Conn: conn}
+}
+
+// Peek returns the next n bytes without consuming them, blocking until they come.
+// Less than n bytes are returned along with an error only.
+func (c *PeekConn) Peek(n int) ([]byte, error) {
+	if c.r == nil {
+		c.r = bufio.NewReader(c.Conn)
+	}
+
+	return c.r.Peek(n)
+}
+
+// Read reads the bytes peeked first.
+func (c *PeekConn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		return c.Conn.Read(p)
+	}
+
+	return c.r.Read(p)
+}
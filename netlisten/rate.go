@@ -0,0 +1,72 @@
+package netlisten
+
+import (
+	"context"
+	"time"
+
+	"github.com/onokonem/go-throttledio/limiter"
+)
+
+// acceptRate limits the connections accepted per second, globally and per client.
+type acceptRate struct {
+	mode    Mode
+	global  *limiter.Limiter
+	clients *limiter.KeyedController
+}
+
+func newAcceptRate(clock limiter.Option, globalCPS int64, perClientCPS int64, mode Mode) *acceptRate {
+	return &acceptRate{
+		mode:   mode,
+		global: limiter.NewController(time.Second, 10, globalCPS, 0, clock).BornLimiter(),
+		clients: limiter.NewKeyedController(
+			limiter.NewController(time.Second, 10, 0, perClientCPS, clock),
+			limiter.WithTTL(time.Second),
+		),
+	}
+}
+
+// wait blocks until the global rate allows the next connection in Block mode.
+// Returns false in case ctx is done.
+func (r *acceptRate) wait(ctx context.Context) bool {
+	if r.mode != Block {
+		return true
+	}
+
+	_, err := r.global.WaitN(ctx, 1)
+
+	return err == nil
+}
+
+// cancelWait returns the rate taken by wait.
+func (r *acceptRate) cancelWait() {
+	if r.mode == Block {
+		r.global.FillUp(-1)
+	}
+}
+
+// allow checks the rates not checked by wait. Returns false in case the connection is to be rejected.
+func (r *acceptRate) allow(key string) bool {
+	if r.mode != Block && r.global.FillUp(1) <= 0 {
+		return false
+	}
+
+	if key != "" && r.clients.Limiter(key).FillUp(1) <= 0 {
+		if r.mode != Block {
+			r.global.FillUp(-1)
+		}
+		return false
+	}
+
+	return true
+}
+
+// cancelAllow returns the rates taken by allow.
+func (r *acceptRate) cancelAllow(key string) {
+	if r.mode != Block {
+		r.global.FillUp(-1)
+	}
+
+	if key != "" {
+		r.clients.Limiter(key).FillUp(-1)
+	}
+}
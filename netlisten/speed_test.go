@@ -8,6 +8,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/onokonem/go-throttledio/clock/clocktest"
+	"github.com/onokonem/go-throttledio/limiter"
 	"github.com/onokonem/go-throttledio/netlisten"
 )
 
@@ -21,43 +23,37 @@ const (
 	Interval     = 10 * time.Second
 	Ticks        = 100
 	TestDuration = 30 * time.Second
+	TestCPS      = 1024 * 1024 // way below the loopback speed, so the limits are reached for sure
 )
 
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) // nolint: gochecknoglobals
+
 // setting bandwidth limit per server
 func TestPerServer(t *testing.T) {
-	l := listen()
+	m := clocktest.NewManual(epoch)
+	l := listenOn(m, 0)
+	defer l.Close()
 
-	clientG := new(int64)
-	client1, client2 := startClients(l.Addr(), clientG)
+	// setting bandwidth limit per server
+	reqSpeedC := int64(TestCPS)
+	l.ReadLimiter().SetCommonCPS(reqSpeedC)
 
 	serverG := new(int64)
-	startAccept(l, serverG)
-
-	startTime := time.Now()
-
-	time.Sleep(Interval / 3)
+	client1, server1 := pair(l, serverG)
+	defer client1.conn.Close()
+	defer server1.conn.Close()
+	client2, server2 := pair(l, serverG)
+	defer client2.conn.Close()
+	defer server2.conn.Close()
 
-	curTime := time.Now()
-	speed1 := float64(atomic.LoadInt64(client1.total)) / curTime.Sub(startTime).Seconds()
-	speed2 := float64(atomic.LoadInt64(client2.total)) / curTime.Sub(startTime).Seconds()
-	speedC := float64(atomic.LoadInt64(clientG)) / curTime.Sub(startTime).Seconds()
-
-	fmt.Printf("Unlimited: speed 1: %f, speed 2: %f, common: %f\n", speed1, speed2, speedC)
-
-	// setting bandwidth limit per server
-	reqSpeedC := int64(speedC) / 10
-	l.(*netlisten.Listener).ReadLimiter().SetCommonCPS(reqSpeedC)
-	atomic.StoreInt64(client1.total, 0)
-	atomic.StoreInt64(client2.total, 0)
-	atomic.StoreInt64(clientG, 0)
+	go server1.read()
+	go server2.read()
 
-	startTime = time.Now()
-	time.Sleep(TestDuration)
+	spent := run(m, 2, TestDuration).Seconds()
 
-	curTime = time.Now()
-	speed1 = float64(atomic.LoadInt64(client1.total)) / curTime.Sub(startTime).Seconds()
-	speed2 = float64(atomic.LoadInt64(client2.total)) / curTime.Sub(startTime).Seconds()
-	speedC = float64(atomic.LoadInt64(clientG)) / curTime.Sub(startTime).Seconds()
+	speed1 := float64(atomic.LoadInt64(server1.total)) / spent
+	speed2 := float64(atomic.LoadInt64(server2.total)) / spent
+	speedC := float64(atomic.LoadInt64(serverG)) / spent
 
 	deviationC := (speedC - float64(reqSpeedC)) / float64(reqSpeedC)
 
@@ -70,42 +66,32 @@ func TestPerServer(t *testing.T) {
 
 // setting bandwidth limit per connection
 func TestPerConn(t *testing.T) {
-	l := listen()
-
-	clientG := new(int64)
-	client1, client2 := startClients(l.Addr(), clientG)
+	m := clocktest.NewManual(epoch)
+	l := listenOn(m, 0)
+	defer l.Close()
 
 	serverG := new(int64)
-	server1, server2 := startAccept(l, serverG)
-
-	startTime := time.Now()
-
-	time.Sleep(Interval / 3)
-
-	curTime := time.Now()
-	speed1 := float64(atomic.LoadInt64(client1.total)) / curTime.Sub(startTime).Seconds()
-	speed2 := float64(atomic.LoadInt64(client2.total)) / curTime.Sub(startTime).Seconds()
-	speedC := float64(atomic.LoadInt64(clientG)) / curTime.Sub(startTime).Seconds()
-
-	fmt.Printf("Unlimited: speed 1: %f, speed 2: %f, common: %f\n", speed1, speed2, speedC)
+	client1, server1 := pair(l, serverG)
+	defer client1.conn.Close()
+	defer server1.conn.Close()
+	client2, server2 := pair(l, serverG)
+	defer client2.conn.Close()
+	defer server2.conn.Close()
 
 	// setting bandwidth limit per connection
-	reqSpeedC := int64(speedC) / 10
-	reqSpeed1 := reqSpeedC / 2
+	reqSpeed1 := int64(TestCPS / 2)
 	server1.conn.SetReadCPS(reqSpeed1)
-	reqSpeed2 := reqSpeedC / 3
+	reqSpeed2 := int64(TestCPS / 3)
 	server2.conn.SetReadCPS(reqSpeed2)
-	atomic.StoreInt64(client1.total, 0)
-	atomic.StoreInt64(client2.total, 0)
-	atomic.StoreInt64(clientG, 0)
 
-	startTime = time.Now()
-	time.Sleep(TestDuration)
+	go server1.read()
+	go server2.read()
+
+	spent := run(m, 2, TestDuration).Seconds()
 
-	curTime = time.Now()
-	speed1 = float64(atomic.LoadInt64(client1.total)) / curTime.Sub(startTime).Seconds()
-	speed2 = float64(atomic.LoadInt64(client2.total)) / curTime.Sub(startTime).Seconds()
-	speedC = float64(atomic.LoadInt64(clientG)) / curTime.Sub(startTime).Seconds()
+	speed1 := float64(atomic.LoadInt64(server1.total)) / spent
+	speed2 := float64(atomic.LoadInt64(server2.total)) / spent
+	speedC := float64(atomic.LoadInt64(serverG)) / spent
 
 	deviation1 := (speed1 - float64(reqSpeed1)) / float64(reqSpeed1)
 	deviation2 := (speed2 - float64(reqSpeed2)) / float64(reqSpeed2)
@@ -122,41 +108,31 @@ func TestPerConn(t *testing.T) {
 
 // changing limits in runtime (applies to all existing connections)
 func TestAllConn(t *testing.T) {
-	l := listen()
-
-	clientG := new(int64)
-	client1, client2 := startClients(l.Addr(), clientG)
+	m := clocktest.NewManual(epoch)
+	l := listenOn(m, 0)
+	defer l.Close()
 
 	serverG := new(int64)
-	startAccept(l, serverG)
-
-	startTime := time.Now()
+	client1, server1 := pair(l, serverG)
+	defer client1.conn.Close()
+	defer server1.conn.Close()
+	client2, server2 := pair(l, serverG)
+	defer client2.conn.Close()
+	defer server2.conn.Close()
 
-	time.Sleep(Interval / 3)
+	// changing limits in runtime (applies to all existing connections)
+	reqSpeed1 := int64(TestCPS / 3)
+	reqSpeed2 := int64(TestCPS / 3)
+	l.ReadLimiter().SetPerChildCPS(reqSpeed1)
 
-	curTime := time.Now()
-	speed1 := float64(atomic.LoadInt64(client1.total)) / curTime.Sub(startTime).Seconds()
-	speed2 := float64(atomic.LoadInt64(client2.total)) / curTime.Sub(startTime).Seconds()
-	speedC := float64(atomic.LoadInt64(clientG)) / curTime.Sub(startTime).Seconds()
+	go server1.read()
+	go server2.read()
 
-	fmt.Printf("Unlimited: speed 1: %f, speed 2: %f, common: %f\n", speed1, speed2, speedC)
+	spent := run(m, 2, TestDuration).Seconds()
 
-	// changing limits in runtime (applies to all existing connections)
-	reqSpeedC := int64(speedC) / 10
-	reqSpeed1 := reqSpeedC / 3
-	reqSpeed2 := reqSpeedC / 3
-	l.(*netlisten.Listener).ReadLimiter().SetPerChildCPS(reqSpeed1)
-	atomic.StoreInt64(client1.total, 0)
-	atomic.StoreInt64(client2.total, 0)
-	atomic.StoreInt64(clientG, 0)
-
-	startTime = time.Now()
-	time.Sleep(TestDuration)
-
-	curTime = time.Now()
-	speed1 = float64(atomic.LoadInt64(client1.total)) / curTime.Sub(startTime).Seconds()
-	speed2 = float64(atomic.LoadInt64(client2.total)) / curTime.Sub(startTime).Seconds()
-	speedC = float64(atomic.LoadInt64(clientG)) / curTime.Sub(startTime).Seconds()
+	speed1 := float64(atomic.LoadInt64(server1.total)) / spent
+	speed2 := float64(atomic.LoadInt64(server2.total)) / spent
+	speedC := float64(atomic.LoadInt64(serverG)) / spent
 
 	deviation1 := (speed1 - float64(reqSpeed1)) / float64(reqSpeed1)
 	deviation2 := (speed2 - float64(reqSpeed2)) / float64(reqSpeed2)
@@ -172,28 +148,28 @@ func TestAllConn(t *testing.T) {
 }
 
 func TestPerServerSetOnStart(t *testing.T) {
-	l, err := net.Listen("tcp4", "127.0.0.1:")
-	if err != nil {
-		panic(err)
-	}
-
-	reqSpeedC := 20000000
-	l = netlisten.LimitListener(l, reqSpeedC, reqSpeedC)
+	m := clocktest.NewManual(epoch)
 
-	clientG := new(int64)
-	client1, client2 := startClients(l.Addr(), clientG)
+	reqSpeedC := int64(TestCPS)
+	l := listenOn(m, reqSpeedC)
+	defer l.Close()
 
 	serverG := new(int64)
-	startAccept(l, serverG)
+	client1, server1 := pair(l, serverG)
+	defer client1.conn.Close()
+	defer server1.conn.Close()
+	client2, server2 := pair(l, serverG)
+	defer client2.conn.Close()
+	defer server2.conn.Close()
 
-	startTime := time.Now()
+	go server1.read()
+	go server2.read()
 
-	time.Sleep(TestDuration)
+	spent := run(m, 2, TestDuration).Seconds()
 
-	curTime := time.Now()
-	speed1 := float64(atomic.LoadInt64(client1.total)) / curTime.Sub(startTime).Seconds()
-	speed2 := float64(atomic.LoadInt64(client2.total)) / curTime.Sub(startTime).Seconds()
-	speedC := float64(atomic.LoadInt64(clientG)) / curTime.Sub(startTime).Seconds()
+	speed1 := float64(atomic.LoadInt64(server1.total)) / spent
+	speed2 := float64(atomic.LoadInt64(server2.total)) / spent
+	speedC := float64(atomic.LoadInt64(serverG)) / spent
 
 	deviationC := (speedC - float64(reqSpeedC)) / float64(reqSpeedC)
 
@@ -210,12 +186,13 @@ type connReader struct {
 	global *int64
 }
 
+// read reads the connection until an error, e.g. the one closed.
 func (c *connReader) read() {
 	b := make([]byte, 16*1024)
 	for {
 		n, err := c.conn.Read(b)
 		if err != nil {
-			panic(err)
+			return
 		}
 
 		atomic.AddInt64(c.total, int64(n))
@@ -237,25 +214,20 @@ func accept(l net.Listener, global *int64) *connReader {
 }
 
 type connWriter struct {
-	total  *int64
-	global *int64
+	conn  net.Conn
+	total *int64
 }
 
-func (c *connWriter) connectAndWrite(a net.Addr) {
-	conn, err := net.Dial(a.Network(), a.String())
-	if err != nil {
-		panic(err)
-	}
-
-	b := make([]byte, 16*1024)
+// write writes the connection until an error, e.g. the one closed.
+// The chunks are small, so the amount written is counted close to the one passed the limits.
+func (c *connWriter) write() {
+	b := make([]byte, 1024)
 	for {
-		n, err := conn.Write(b)
+		n, err := c.conn.Write(b)
+		atomic.AddInt64(c.total, int64(n))
 		if err != nil {
-			panic(err)
+			return
 		}
-
-		atomic.AddInt64(c.total, int64(n))
-		atomic.AddInt64(c.global, int64(n))
 	}
 }
 
@@ -268,29 +240,45 @@ func listen() net.Listener {
 	return netlisten.LimitListener(l, 0, 0)
 }
 
-func startClients(addr net.Addr, global *int64) (*connWriter, *connWriter) {
-	return startClient(addr, global), startClient(addr, global)
+// listenOn returns a Listener with the Controllers on m, cps is the common limit of both.
+func listenOn(m *clocktest.Manual, cps int64) *netlisten.Listener {
+	l, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		panic(err)
+	}
+
+	return netlisten.NewListener(
+		l,
+		limiter.NewController(Interval, Ticks, cps, 0, limiter.WithClock(m)),
+		limiter.NewController(Interval, Ticks, cps, 0, limiter.WithClock(m)),
+	)
 }
 
-func startClient(addr net.Addr, global *int64) *connWriter {
-	client := &connWriter{total: new(int64), global: global}
+// pair dials the Listener and accepts the connection dialed, so the client and the server ends match for sure.
+// The client writes as fast as it can, the server end is not read yet.
+func pair(l net.Listener, global *int64) (*connWriter, *connReader) {
+	conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
 
-	go client.connectAndWrite(addr)
+	client := &connWriter{conn: conn, total: new(int64)}
+	go client.write()
 
-	return client
+	return client, accept(l, global)
 }
 
-func startAccept(l net.Listener, global *int64) (*connReader, *connReader) {
-	server1 := accept(l, global)
-	server2 := accept(l, global)
+// run moves m from a Timer to a Timer for d at least, each time waiting for n throttled goroutines
+// to wait for the limits, so all they have passed is counted. Returns the time passed.
+func run(m *clocktest.Manual, n int, d time.Duration) time.Duration {
+	startTime := m.Now()
 
-	go func() {
-		conn, err := l.Accept()
-		panic(fmt.Errorf("unexpected %v %v", conn, err))
-	}()
+	for m.Now().Sub(startTime) < d {
+		m.BlockUntil(n)
+		m.Next()
+	}
 
-	go server1.read()
-	go server2.read()
+	m.BlockUntil(n)
 
-	return server1, server2
+	return m.Now().Sub(startTime)
 }
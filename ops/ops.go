@@ -0,0 +1,67 @@
+// Package ops limits the operations rate: requests, messages, items or IOPS,
+// each operation costs some units of a limiter.Limiter.
+package ops
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/onokonem/go-throttledio/limiter"
+)
+
+// Cost returns a number of units the request costs.
+type Cost func(r *http.Request) int64
+
+// Fixed returns a Cost being n for any request.
+func Fixed(n int64) Cost {
+	return func(*http.Request) int64 {
+		return n
+	}
+}
+
+// Func wraps f, so each call waits for cost units granted first.
+// limiter.Limiter Wait error is returned with f not called, e.g. in case ctx is done.
+func Func(l *limiter.Limiter, cost int64, f func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if err := l.Wait(ctx, cost); err != nil {
+			return err
+		}
+
+		return f(ctx)
+	}
+}
+
+// Handler wraps h, so the requests not allowed are answered with 429 Too Many Requests.
+// cost is called for each request, nil means 1 unit.
+func Handler(l *limiter.Limiter, cost Cost, h http.Handler) http.Handler {
+	if cost == nil {
+		cost = Fixed(1)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.Allow(cost(r)) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// WaitHandler wraps h, so each request waits for the units granted first.
+// The requests not able to be allowed, e.g. canceled by the client, are answered with 429 Too Many Requests.
+// cost is called for each request, nil means 1 unit.
+func WaitHandler(l *limiter.Limiter, cost Cost, h http.Handler) http.Handler {
+	if cost == nil {
+		cost = Fixed(1)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := l.Wait(r.Context(), cost(r)); err != nil {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
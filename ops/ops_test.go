@@ -0,0 +1,177 @@
+package ops_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/clock/clocktest"
+	"github.com/onokonem/go-throttledio/limiter"
+	"github.com/onokonem/go-throttledio/ops"
+)
+
+const (
+	interval = time.Second * 3
+	ticks    = 100
+)
+
+func newLimiter(cps int64) (*limiter.Limiter, *clocktest.Manual) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := limiter.NewController(interval, ticks, cps, 0, limiter.WithClock(m)).BornLimiter()
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	return l, m
+}
+
+func TestHandler(t *testing.T) {
+	l, _ := newLimiter(1)
+
+	h := ops.Handler(l, func(r *http.Request) int64 {
+		if r.Method == http.MethodPost {
+			return 2
+		}
+		return 1
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, c := range []struct {
+		method   string
+		expected int
+	}{
+		{http.MethodPost, http.StatusOK},
+		{http.MethodPost, http.StatusTooManyRequests},
+		{http.MethodGet, http.StatusOK},
+		{http.MethodGet, http.StatusTooManyRequests},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(c.method, "/", nil))
+
+		if w.Code != c.expected {
+			t.Errorf("%d: expected %d, got %d", i, c.expected, w.Code)
+		}
+	}
+}
+
+func TestWaitHandler(t *testing.T) {
+	l, m := newLimiter(1)
+
+	h := ops.WaitHandler(l, ops.Fixed(3), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, w.Code)
+	}
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- w.Code
+	}()
+
+	m.BlockUntil(1)
+	m.Advance(interval)
+
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestFunc(t *testing.T) {
+	l, m := newLimiter(1)
+
+	calls := 0
+	f := ops.Func(l, 2, func(ctx context.Context) error {
+		calls++
+		return nil
+	})
+
+	if err := f(context.Background()); err != nil || calls != 1 {
+		t.Errorf("expected (nil, 1), got (%v, %d)", err, calls)
+	}
+
+	ctx, cancel := clock.WithDeadline(context.Background(), m, m.Now().Add(time.Second))
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- f(ctx)
+	}()
+
+	// the deadline and the wait
+	m.BlockUntil(2)
+	m.Advance(time.Second)
+
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) || calls != 1 {
+		t.Errorf("expected (%v, 1), got (%v, %d)", context.DeadlineExceeded, err, calls)
+	}
+}
+
+func TestFuncRate(t *testing.T) {
+	const (
+		cps  = 100
+		cost = 20
+	)
+
+	l, m := newLimiter(cps)
+
+	var (
+		startTime = m.Now()
+		endTime   = startTime.Add(interval * 10)
+		calls     []time.Time
+	)
+
+	f := ops.Func(l, cost, func(ctx context.Context) error {
+		calls = append(calls, m.Now())
+		return nil
+	})
+
+	done := make(chan error)
+	go func() {
+		for m.Now().Before(endTime) {
+			if err := f(context.Background()); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// move the clock from a wait to a wait until the calls are over
+	for waiting := true; waiting; runtime.Gosched() {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			waiting = false
+		default:
+			m.Next()
+		}
+	}
+
+	// no window of the interval long ever gets more than the limit allows
+	max := int64(cps * interval / time.Second)
+	for i, from := 0, 0; i < len(calls); i++ {
+		for !calls[from].After(calls[i].Add(-interval)) {
+			from++
+		}
+		if total := int64(i-from+1) * cost; total > max {
+			t.Fatalf("expected no more than %d for the interval, got %d at %v", max, total, calls[i].Sub(startTime))
+		}
+	}
+
+	rate := float64(len(calls)*cost) / m.Now().Sub(startTime).Seconds()
+	if math.Abs(rate-cps)/cps > 0.05 {
+		t.Errorf("expected about %d per second, got %3.3f", cps, rate)
+	}
+}
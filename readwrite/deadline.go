@@ -0,0 +1,202 @@
+package readwrite
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/internal/atomic"
+	"github.com/onokonem/go-throttledio/limiter"
+)
+
+// deadline is an absolute deadline able to wake up the pending waits when changed.
+type deadline struct {
+	clock   clock.Clock
+	t       *atomic.Time
+	changed chan struct{}
+	lock    sync.Mutex
+}
+
+func newDeadline(clock clock.Clock) *deadline {
+	return &deadline{
+		clock:   clock,
+		t:       atomic.NewTime(time.Time{}),
+		changed: make(chan struct{}),
+	}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.t.Set(t)
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+func (d *deadline) reached() bool {
+	t := d.t.Get()
+	return !t.IsZero() && !d.clock.Now().Before(t)
+}
+
+// context returns a context derived from parent done when the deadline is reached or changed.
+func (d *deadline) context(parent context.Context) *waitContext {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return &waitContext{
+		Context: parent,
+		clock:   d.clock,
+		t:       d.t.Get(),
+		changed: d.changed,
+	}
+}
+
+// waitContext is a context of the deadline.
+// Nothing is started until Done is called, as the limiter grants at once mostly.
+type waitContext struct {
+	context.Context
+	clock   clock.Clock
+	t       time.Time
+	changed chan struct{}
+	once    sync.Once
+	done    context.Context
+	stop    context.CancelFunc
+}
+
+func (w *waitContext) start() {
+	w.once.Do(func() {
+		if w.t.IsZero() {
+			w.done, w.stop = context.WithCancel(w.Context)
+		} else {
+			w.done, w.stop = clock.WithDeadline(w.Context, w.clock, w.t)
+		}
+
+		go func() {
+			select {
+			case <-w.changed:
+				w.stop()
+			case <-w.done.Done():
+			}
+		}()
+	})
+}
+
+// cancel releases the context, returns true in case it was waited on.
+func (w *waitContext) cancel() bool {
+	w.once.Do(func() {})
+	if w.stop == nil {
+		return false
+	}
+
+	w.stop()
+
+	return true
+}
+
+func (w *waitContext) Deadline() (time.Time, bool) {
+	if t, ok := w.Context.Deadline(); ok && (w.t.IsZero() || t.Before(w.t)) {
+		return t, ok
+	}
+
+	return w.t, !w.t.IsZero()
+}
+
+func (w *waitContext) Done() <-chan struct{} {
+	w.start()
+	return w.done.Done()
+}
+
+func (w *waitContext) Err() error {
+	if err := w.Context.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case <-w.changed:
+		return context.Canceled
+	default:
+	}
+
+	if !w.t.IsZero() && !w.clock.Now().Before(w.t) {
+		return context.DeadlineExceeded
+	}
+
+	return nil
+}
+
+// fillUp asks the limiter for n, waiting for the deadline or ctx done if not fragile.
+// Nothing is waited for in case the limiter quota is exhausted.
+// ErrExceeded and ErrDeadline are reported to the limiter hooks and to h, EventThrottled is reported to h only,
+// as the limiter reports it itself.
+func fillUp(ctx context.Context, l limiter.Throttle, h limiter.Hook, fragile bool, d *deadline, n int64) (int64, error) {
+	startTime := d.clock.Now()
+
+	for {
+		if d.reached() {
+			report(l, h, limiter.Event{Kind: limiter.EventDeadline, Requested: n, Waited: d.clock.Now().Sub(startTime)})
+			return 0, ErrDeadline
+		}
+
+		if err := ctx.Err(); err != nil {
+			return 0, contextError(err)
+		}
+
+		if fragile {
+			if allowed := l.FillUp(n); allowed > 0 {
+				if allowed < n {
+					call(l, h, limiter.Event{Kind: limiter.EventThrottled, Requested: n, Granted: allowed})
+				}
+				return allowed, nil
+			}
+
+			if left, _ := l.QuotaLeft(); left <= 0 {
+				return 0, ErrQuotaExhausted
+			}
+
+			report(l, h, limiter.Event{Kind: limiter.EventExceeded, Requested: n})
+			return 0, ErrExceeded
+		}
+
+		// WaitN grants at once if able to, so the request is not counted twice
+		waitCtx := d.context(ctx)
+		allowed, err := l.WaitN(waitCtx, n)
+		waited := waitCtx.cancel()
+
+		switch {
+		case err == nil:
+			if allowed < n || waited {
+				call(l, h, limiter.Event{
+					Kind:      limiter.EventThrottled,
+					Requested: n,
+					Granted:   allowed,
+					Waited:    d.clock.Now().Sub(startTime),
+				})
+			}
+			return allowed, nil
+		case errors.Is(err, limiter.ErrQuotaExhausted):
+			return 0, ErrQuotaExhausted
+		}
+	}
+}
+
+// report passes e to the limiter hooks and to h.
+func report(l limiter.Throttle, h limiter.Hook, e limiter.Event) {
+	l.Report(e)
+	call(l, h, e)
+}
+
+// call passes e to h, if any. The event Limiter is set to l in case it is a Limiter.
+func call(l limiter.Throttle, h limiter.Hook, e limiter.Event) {
+	if h == nil {
+		return
+	}
+
+	if e.Limiter == nil {
+		e.Limiter, _ = l.(*limiter.Limiter)
+	}
+
+	h(e)
+}
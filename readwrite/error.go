@@ -1,14 +1,19 @@
 package readwrite
 
 import (
+	"context"
 	"errors"
 	"net"
+
+	"github.com/onokonem/go-throttledio/limiter"
 )
 
 // Errors
 var (
 	ErrExceeded = &Error{errors.New("bandwidth exceeded"), false, true}
 	ErrDeadline = &Error{errors.New("deadline reached"), true, false}
+
+	ErrQuotaExhausted = &Error{limiter.ErrQuotaExhausted, false, false}
 )
 
 var (
@@ -28,3 +33,11 @@ func (e *Error) Timeout() bool { return e.timeout }
 
 // Temporary flag
 func (e *Error) Temporary() bool { return e.temporary }
+
+// Unwrap returns the underlaying error, e.g. limiter.ErrQuotaExhausted or ctx.Err().
+func (e *Error) Unwrap() error { return e.error }
+
+// contextError wraps ctx.Err(), the context deadline is a timeout.
+func contextError(err error) *Error {
+	return &Error{err, errors.Is(err, context.DeadlineExceeded), false}
+}
@@ -0,0 +1,40 @@
+package readwrite
+
+import (
+	"github.com/onokonem/go-throttledio/clock"
+	"github.com/onokonem/go-throttledio/limiter"
+)
+
+// Option is a Reader or Writer option.
+type Option func(*options)
+
+type options struct {
+	clock clock.Clock
+	hook  limiter.Hook
+}
+
+// WithClock sets a time source the deadlines are checked with.
+// The limiter one is used by default.
+func WithClock(clock clock.Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithHook sets a hook called on the Reader or Writer events:
+// EventThrottled on less than asked granted or a wait, EventExceeded and EventDeadline on the errors.
+// The limiter hooks are called as usual.
+func WithHook(h limiter.Hook) Option {
+	return func(o *options) {
+		o.hook = h
+	}
+}
+
+func newOptions(l limiter.Throttle, opts []Option) *options {
+	o := &options{clock: l.Clock()}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
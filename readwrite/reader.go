@@ -1,66 +1,77 @@
 package readwrite
 
 import (
+	"context"
 	"io"
 	"time"
 
-	"github.com/onokonem/go-throttledio/internal/atomic"
 	"github.com/onokonem/go-throttledio/limiter"
 )
 
-const readRetryDelay = time.Microsecond
-
 // Reader is a wrapper for io.Reader with throttling implemented
 type Reader struct {
 	r        io.Reader
-	limiter  *limiter.Limiter
+	limiter  limiter.Throttle
 	fragile  bool
-	deadline *atomic.Time
+	deadline *deadline
+	hook     limiter.Hook
+	ctx      context.Context
 }
 
 // NewReader makes the Reader instance
 // r in an underlaing io.Reader
-// limiter is a limiter instance to be used to contron Reader bandwidth
+// limiter is a limiter instance, or a Joint of them, to be used to contron Reader bandwidth
 // fragile flags controls will the reader return an error on bandwidth exceeded,
-// or will it retry until deadline.
-func NewReader(r io.Reader, limiter *limiter.Limiter, fragile bool) *Reader {
+// or will it wait until deadline.
+// opts are applied in order provided.
+func NewReader(r io.Reader, limiter limiter.Throttle, fragile bool, opts ...Option) *Reader {
+	o := newOptions(limiter, opts)
+
 	return &Reader{
 		r:        r,
 		limiter:  limiter,
 		fragile:  fragile,
-		deadline: atomic.NewTime(time.Time{}),
+		deadline: newDeadline(o.clock),
+		hook:     o.hook,
+		ctx:      context.Background(),
 	}
 }
 
-// SetDeadline sets a deadline for the next Read.
+// NewReaderContext makes the Reader instance bound to ctx: Read waits stop on ctx done.
+// See NewReader for the other parameters.
+func NewReaderContext(ctx context.Context, r io.Reader, limiter limiter.Throttle, fragile bool, opts ...Option) *Reader {
+	reader := NewReader(r, limiter, fragile, opts...)
+	reader.ctx = ctx
+
+	return reader
+}
+
+// SetDeadline sets a deadline for the next and currently waiting Read.
 func (r *Reader) SetDeadline(t time.Time) {
-	r.deadline.Set(t)
+	r.deadline.set(t)
 }
 
 // Read method to implement io.Reader interface
 func (r *Reader) Read(p []byte) (n int, err error) {
+	return r.ReadContext(r.ctx, p)
+}
+
+// ReadContext is Read waiting until ctx done at most, ctx.Err() is returned wrapped into Error then.
+// The context bound by NewReaderContext is not used.
+func (r *Reader) ReadContext(ctx context.Context, p []byte) (n int, err error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
 
-	for {
-		if deadline := r.deadline.Get(); !deadline.IsZero() && time.Now().After(deadline) {
-			return 0, ErrDeadline
-		}
-		allowed := r.limiter.FillUp(int64(len(p)))
-		if allowed <= 0 {
-			if r.fragile {
-				return 0, ErrExceeded
-			}
-			time.Sleep(readRetryDelay)
-			continue
-		}
-
-		n, err = r.r.Read(p[:allowed])
-		if left := int64(n) - allowed; left < 0 {
-			r.limiter.FillUp(left)
-		}
+	allowed, err := fillUp(ctx, r.limiter, r.hook, r.fragile, r.deadline, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
 
-		return n, err
+	n, err = r.r.Read(p[:allowed])
+	if left := int64(n) - allowed; left < 0 {
+		r.limiter.FillUp(left)
 	}
+
+	return n, err
 }
@@ -1,6 +1,7 @@
 package readwrite_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -9,37 +10,39 @@ import (
 	"testing"
 	"time"
 
+	"github.com/onokonem/go-throttledio/clock/clocktest"
 	"github.com/onokonem/go-throttledio/limiter"
 	"github.com/onokonem/go-throttledio/readwrite"
 )
 
 func TestReaderDelay(t *testing.T) {
-	l := limiter.NewController(interval, ticks, 0, 0).BornLimiter()
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m)).BornLimiter()
 	cw := &countingWriter{w: ioutil.Discard}
 	r := readwrite.NewReader(&noOpReader{}, l, false)
 
 	amount := testAmount / 2
-	spent := cp(cw, r, amount)
-	maxSpeed := int64(float64(cw.counter) / spent.Seconds())
-	fmt.Printf("unthrotled speed: %d bytes in %v: %d bps\n", amount, spent, maxSpeed)
+	if spent := cp(m, cw, r, amount); spent != 0 {
+		t.Errorf("expected no time spent unthrottled, got %v", spent)
+	}
 
 	if cw.counter != amount {
-		t.Errorf("expected %d, got %d", testAmount, cw.counter)
+		t.Errorf("expected %d, got %d", amount, cw.counter)
 	}
 
 	cw.counter = 0
-	l.SetCPS(maxSpeed / 2)
+	l.SetCPS(testCPS)
 
-	amount = testAmount / 4
-	spent = cp(cw, r, amount)
-	speed := float64(maxSpeed / 2)
+	amount = testAmount
+	spent := cp(m, cw, r, amount)
+	speed := float64(testCPS)
 	realSpeed := float64(cw.counter) / spent.Seconds()
 	deviation := (realSpeed - speed) / speed
 
 	fmt.Printf("throtled speed: %2.2f bps, %d bytes in %v: %2.2f bps, deviation %3.3f\n", speed, amount, spent, realSpeed, deviation)
 
 	if cw.counter != amount {
-		t.Errorf("expected %d, got %d", testAmount, cw.counter)
+		t.Errorf("expected %d, got %d", amount, cw.counter)
 	}
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %f", deviation)
@@ -47,20 +50,114 @@ func TestReaderDelay(t *testing.T) {
 }
 
 func TestReadDeadline(t *testing.T) {
-	r := readwrite.NewReader(&noOpReader{}, limiter.NewController(interval, ticks, 1, 1).BornLimiter(), false)
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := readwrite.NewReader(&noOpReader{}, limiter.NewController(interval, ticks, 1, 1, limiter.WithClock(m)).BornLimiter(), false)
 
 	timeout := interval * 2
-	startTime := time.Now()
+	startTime := m.Now()
 	r.SetDeadline(startTime.Add(timeout))
 
-	_, err := io.CopyN(ioutil.Discard, r, 1000)
+	done := make(chan error)
+	go func() {
+		_, err := io.CopyN(ioutil.Discard, r, 1000)
+		done <- err
+	}()
+
+	if err := drive(m, done); !errors.Is(err, readwrite.ErrDeadline) {
+		t.Errorf("expected %v, got %v", readwrite.ErrDeadline, err)
+	}
+
+	if spent := m.Now().Sub(startTime); spent != timeout {
+		t.Errorf("expected %v, got %v", timeout, spent)
+	}
+}
+
+func TestReadDeadlineChanged(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := readwrite.NewReader(&noOpReader{}, limiter.NewController(interval, ticks, 1, 1, limiter.WithClock(m)).BornLimiter(), false)
+
+	errCh := make(chan error)
+	go func() {
+		_, err := io.CopyN(ioutil.Discard, r, 1000)
+		errCh <- err
+	}()
+
+	// the Read is waiting for the limiter, the deadline set has to stop it with no time passed
+	m.BlockUntil(1)
+	r.SetDeadline(m.Now())
+
+	err := <-errCh
 	if err == nil || !errors.Is(err, readwrite.ErrDeadline) {
 		t.Errorf("expected %v, got %v", readwrite.ErrDeadline, err)
 	}
+}
+
+func TestReadDeadlineManualClock(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := limiter.NewController(interval, ticks, 1, 1, limiter.WithClock(m)).BornLimiter()
+	r := readwrite.NewReader(&noOpReader{}, l, false)
+
+	r.SetDeadline(m.Now().Add(time.Hour))
+
+	done := make(chan error)
+	go func() {
+		_, err := io.CopyN(ioutil.Discard, r, 1000)
+		done <- err
+	}()
 
-	spent := time.Now().Sub(startTime)
-	if r := math.Abs(float64(spent-timeout)) / float64(timeout); r > 0.001 {
-		t.Errorf("expected %v, got %v (%f)", timeout, spent, r)
+	// the limiter wait and the deadline
+	m.BlockUntil(2)
+	m.Advance(time.Hour)
+
+	if err := <-done; !errors.Is(err, readwrite.ErrDeadline) {
+		t.Errorf("expected %v, got %v", readwrite.ErrDeadline, err)
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := limiter.NewController(interval, ticks, 1, 1, limiter.WithClock(m)).BornLimiter()
+	l.FillUp(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := readwrite.NewReaderContext(ctx, &noOpReader{}, l, false)
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 1000))
+		done <- err
+	}()
+
+	m.BlockUntil(1)
+	cancel()
+
+	err := <-done
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	var rwErr *readwrite.Error
+	if !errors.As(err, &rwErr) || rwErr.Timeout() || rwErr.Temporary() {
+		t.Errorf("expected readwrite error, got %#v", err)
+	}
+
+	// the bound context is not used by ReadContext
+	m.Advance(interval)
+
+	if n, err := r.ReadContext(context.Background(), make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("expected (1, nil), got (%d, %v)", n, err)
+	}
+}
+
+func TestReadQuota(t *testing.T) {
+	l := limiter.NewController(interval, ticks, 0, 0).BornLimiter()
+	l.SetQuota(limiter.Quota{Amount: 1000, Period: limiter.PeriodDay})
+
+	for i, expected := range []int64{1000, 0} {
+		n, err := io.CopyN(ioutil.Discard, readwrite.NewReader(&noOpReader{}, l, i > 0), 2000)
+		if n != expected || err != readwrite.ErrQuotaExhausted || !errors.Is(err, limiter.ErrQuotaExhausted) {
+			t.Errorf("%d: expected (%d, %v), got (%d, %v)", i, expected, readwrite.ErrQuotaExhausted, n, err)
+		}
 	}
 }
 
@@ -73,6 +170,114 @@ func TestReadFragile(t *testing.T) {
 	}
 }
 
+func TestReadRequested(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m)).BornLimiter()
+	r := readwrite.NewReader(&noOpReader{}, l, false)
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	if n, err := r.Read(make([]byte, 100)); n != 100 || err != nil {
+		t.Errorf("expected (100, nil), got (%d, %v)", n, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 50))
+		done <- err
+	}()
+
+	m.BlockUntil(1)
+	m.Advance(interval)
+
+	if err := <-done; err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	// the throttled Read is counted once
+	if s := l.Stats(); s.Requested != 150 || s.Denials != 1 {
+		t.Errorf("expected 150 requested and 1 denial, got %+v", s)
+	}
+}
+
+func TestReadHook(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := limiter.NewController(interval, ticks, 100, 0, limiter.WithClock(m)).BornLimiter()
+
+	var kinds []limiter.EventKind
+	hook := readwrite.WithHook(func(e limiter.Event) {
+		if e.Limiter != l {
+			t.Errorf("expected %p, got %p", l, e.Limiter)
+		}
+		kinds = append(kinds, e.Kind)
+	})
+
+	r := readwrite.NewReader(&noOpReader{}, l, false, hook)
+	fragile := readwrite.NewReader(&noOpReader{}, l, true, hook)
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	if n, err := r.Read(make([]byte, 150)); n != 100 || err != nil {
+		t.Errorf("expected (100, nil), got (%d, %v)", n, err)
+	}
+
+	if _, err := fragile.Read(make([]byte, 1)); !errors.Is(err, readwrite.ErrExceeded) {
+		t.Errorf("expected %v, got %v", readwrite.ErrExceeded, err)
+	}
+
+	r.SetDeadline(m.Now().Add(time.Hour))
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	// the limiter wait and the deadline
+	m.BlockUntil(2)
+	m.Advance(interval)
+
+	if err := <-done; err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	r.SetDeadline(m.Now())
+
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, readwrite.ErrDeadline) {
+		t.Errorf("expected %v, got %v", readwrite.ErrDeadline, err)
+	}
+
+	expected := []limiter.EventKind{limiter.EventThrottled, limiter.EventExceeded, limiter.EventThrottled, limiter.EventDeadline}
+	if fmt.Sprint(kinds) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, kinds)
+	}
+}
+
+func TestReadComposite(t *testing.T) {
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := limiter.NewComposite(
+		limiter.Dimension{Limiter: limiter.NewController(interval, ticks, 300, 0, limiter.WithClock(m)).BornLimiter(), PerUnit: 1},
+		limiter.Dimension{Limiter: limiter.NewController(interval, ticks, 3, 0, limiter.WithClock(m)).BornLimiter(), PerCall: 1},
+	)
+	r := readwrite.NewReader(&noOpReader{}, c, true)
+
+	// let the measures made on Reset go
+	m.Advance(interval)
+
+	// each Read is an op, 3 ops and 300 bytes per interval
+	for i, expected := range []int{100, 100, 50} {
+		if n, err := r.Read(make([]byte, 100)[:expected]); n != expected || err != nil {
+			t.Errorf("%d: expected (%d, nil), got (%d, %v)", i, expected, n, err)
+		}
+	}
+
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, readwrite.ErrExceeded) {
+		t.Errorf("expected %v, got %v", readwrite.ErrExceeded, err)
+	}
+}
+
 func TestReadError(t *testing.T) {
 	r := readwrite.NewReader(&errReader{}, limiter.NewController(interval, ticks, 0, 0).BornLimiter(), false)
 
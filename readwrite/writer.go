@@ -1,60 +1,73 @@
 package readwrite
 
 import (
+	"context"
 	"io"
 	"time"
 
-	"github.com/onokonem/go-throttledio/internal/atomic"
 	"github.com/onokonem/go-throttledio/limiter"
 )
 
-const writeRetryDelay = time.Microsecond
-
 // Writer is a wrapper for io.Writer with throttling implemented
 type Writer struct {
 	writer   io.Writer
-	limiter  *limiter.Limiter
+	limiter  limiter.Throttle
 	fragile  bool
-	deadline *atomic.Time
+	deadline *deadline
+	hook     limiter.Hook
+	ctx      context.Context
 }
 
 // NewWriter makes the Writer instance
 // w in an underlaing io.Writer
-// limiter is a limiter instance to be used to contron Writer bandwidth
+// limiter is a limiter instance, or a Joint of them, to be used to contron Writer bandwidth
 // fragile flags controlss will the writer return an error on bandwidth exceeded,
-// or will it retry until deadline.
-func NewWriter(w io.Writer, limiter *limiter.Limiter, fragile bool) *Writer {
+// or will it wait until deadline.
+// opts are applied in order provided.
+func NewWriter(w io.Writer, limiter limiter.Throttle, fragile bool, opts ...Option) *Writer {
+	o := newOptions(limiter, opts)
+
 	return &Writer{
 		writer:   w,
 		limiter:  limiter,
 		fragile:  fragile,
-		deadline: atomic.NewTime(time.Time{}),
+		deadline: newDeadline(o.clock),
+		hook:     o.hook,
+		ctx:      context.Background(),
 	}
 }
 
-// SetDeadline sets a deadline for the next Write.
+// NewWriterContext makes the Writer instance bound to ctx: Write waits stop on ctx done.
+// See NewWriter for the other parameters.
+func NewWriterContext(ctx context.Context, w io.Writer, limiter limiter.Throttle, fragile bool, opts ...Option) *Writer {
+	writer := NewWriter(w, limiter, fragile, opts...)
+	writer.ctx = ctx
+
+	return writer
+}
+
+// SetDeadline sets a deadline for the next and currently waiting Write.
 func (w *Writer) SetDeadline(t time.Time) {
-	w.deadline.Set(t)
+	w.deadline.set(t)
 }
 
 // Write method to implement io.Writer interface
 func (w *Writer) Write(p []byte) (n int, err error) {
+	return w.WriteContext(w.ctx, p)
+}
+
+// WriteContext is Write waiting until ctx done at most, ctx.Err() is returned wrapped into Error then.
+// The context bound by NewWriterContext is not used.
+func (w *Writer) WriteContext(ctx context.Context, p []byte) (n int, err error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
 	b := p
 
 	for len(b) > 0 {
-		if deadline := w.deadline.Get(); !deadline.IsZero() && time.Now().After(deadline) {
-			return len(p) - len(b), ErrDeadline
-		}
-		allowed := w.limiter.FillUp(int64(len(b)))
-		if allowed <= 0 {
-			if w.fragile {
-				return len(p) - len(b), ErrExceeded
-			}
-			time.Sleep(writeRetryDelay)
-			continue
+		allowed, err := fillUp(ctx, w.limiter, w.hook, w.fragile, w.deadline, int64(len(b)))
+		if err != nil {
+			return len(p) - len(b), err
 		}
 		n, err = w.writer.Write(b[:allowed])
 		if left := int64(n) - allowed; left < 0 {
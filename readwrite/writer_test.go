@@ -1,66 +1,59 @@
 package readwrite_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"runtime"
 	"testing"
 	"time"
 
+	"github.com/onokonem/go-throttledio/clock/clocktest"
 	"github.com/onokonem/go-throttledio/limiter"
 	"github.com/onokonem/go-throttledio/readwrite"
 )
 
 const (
 	testDuration = time.Second * 10
+	testCPS      = 1024 * 1024
+	testAmount   = testCPS * int64(testDuration/time.Second)
 	interval     = time.Second * 1
 	ticks        = 100
 	concurency   = 10
 	maxDeviation = 0.05
 )
 
-var testAmount = func() int64 {
-	n := int64(1024 * 1024)
-	for {
-		startTime := time.Now()
-		io.CopyN(ioutil.Discard, &noOpReader{}, n)
-		if spent := time.Now().Sub(startTime); spent >= testDuration/10 {
-			fmt.Printf("test amount: %d (%v)\n", n, spent)
-			return n
-		}
-		n *= 2
-	}
-}()
-
 func TestWriterDelay(t *testing.T) {
-	l := limiter.NewController(interval, ticks, 0, 0).BornLimiter()
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := limiter.NewController(interval, ticks, 0, 0, limiter.WithClock(m)).BornLimiter()
 	cw := &countingWriter{w: ioutil.Discard}
 	w := readwrite.NewWriter(cw, l, false)
 
 	amount := testAmount / 2
-	spent := cp(w, &noOpReader{}, amount)
-	maxSpeed := int64(float64(cw.counter) / spent.Seconds())
-	fmt.Printf("unthrotled speed: %d bytes in %v: %d bps\n", amount, spent, maxSpeed)
+	if spent := cp(m, w, &noOpReader{}, amount); spent != 0 {
+		t.Errorf("expected no time spent unthrottled, got %v", spent)
+	}
 
 	if cw.counter != amount {
-		t.Errorf("expected %d, got %d", testAmount, cw.counter)
+		t.Errorf("expected %d, got %d", amount, cw.counter)
 	}
 
 	cw.counter = 0
-	l.SetCPS(maxSpeed / 2)
+	l.SetCPS(testCPS)
 
-	amount = testAmount / 4
-	spent = cp(w, &noOpReader{}, amount)
-	speed := float64(maxSpeed / 2)
+	amount = testAmount
+	spent := cp(m, w, &noOpReader{}, amount)
+	speed := float64(testCPS)
 	realSpeed := float64(cw.counter) / spent.Seconds()
 	deviation := (realSpeed - speed) / speed
 
 	fmt.Printf("throtled speed: %2.2f bps, %d bytes in %v: %2.2f bps, deviation %3.3f\n", speed, amount, spent, realSpeed, deviation)
 
 	if cw.counter != amount {
-		t.Errorf("expected %d, got %d", testAmount, cw.counter)
+		t.Errorf("expected %d, got %d", amount, cw.counter)
 	}
 	if math.Abs(deviation) > maxDeviation {
 		t.Errorf("deviation is too big: %f", deviation)
@@ -68,20 +61,52 @@ func TestWriterDelay(t *testing.T) {
 }
 
 func TestWriteDeadline(t *testing.T) {
-	w := readwrite.NewWriter(ioutil.Discard, limiter.NewController(interval, ticks, 1, 1).BornLimiter(), false)
+	m := clocktest.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	w := readwrite.NewWriter(ioutil.Discard, limiter.NewController(interval, ticks, 1, 1, limiter.WithClock(m)).BornLimiter(), false)
 
 	timeout := interval * 2
-	startTime := time.Now()
+	startTime := m.Now()
 	w.SetDeadline(startTime.Add(timeout))
 
-	_, err := w.Write(make([]byte, 1000))
-	if err == nil || !errors.Is(err, readwrite.ErrDeadline) {
+	done := make(chan error)
+	go func() {
+		_, err := w.Write(make([]byte, 1000))
+		done <- err
+	}()
+
+	if err := drive(m, done); !errors.Is(err, readwrite.ErrDeadline) {
 		t.Errorf("expected %v, got %v", readwrite.ErrDeadline, err)
 	}
 
-	spent := time.Now().Sub(startTime)
-	if r := math.Abs(float64(spent-timeout)) / float64(timeout); r > 0.001 {
-		t.Errorf("expected %v, got %v (%f)", timeout, spent, r)
+	if spent := m.Now().Sub(startTime); spent != timeout {
+		t.Errorf("expected %v, got %v", timeout, spent)
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	l := limiter.NewController(interval, ticks, 1, 1).BornLimiter()
+	l.FillUp(1)
+
+	w := readwrite.NewWriter(ioutil.Discard, l, false)
+
+	timeout := interval / 10
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	startTime := time.Now()
+
+	n, err := w.WriteContext(ctx, make([]byte, 1000))
+	if !errors.Is(err, context.DeadlineExceeded) || n != 0 {
+		t.Errorf("expected (0, %v), got (%d, %v)", context.DeadlineExceeded, n, err)
+	}
+
+	var rwErr *readwrite.Error
+	if !errors.As(err, &rwErr) || !rwErr.Timeout() {
+		t.Errorf("expected readwrite timeout error, got %#v", err)
+	}
+
+	if spent := time.Since(startTime); spent > timeout*2 {
+		t.Errorf("expected about %v, got %v", timeout, spent)
 	}
 }
 
@@ -94,6 +119,22 @@ func TestWriteFragile(t *testing.T) {
 	}
 }
 
+func TestWriteHook(t *testing.T) {
+	var events []limiter.Event
+	w := readwrite.NewWriter(ioutil.Discard, limiter.NewController(interval, ticks, 1, 1).BornLimiter(), true,
+		readwrite.WithHook(func(e limiter.Event) { events = append(events, e) }),
+	)
+
+	_, err := w.Write(make([]byte, 1000))
+	if !errors.Is(err, readwrite.ErrExceeded) {
+		t.Errorf("expected %v, got %v", readwrite.ErrExceeded, err)
+	}
+
+	if len(events) == 0 || events[len(events)-1].Kind != limiter.EventExceeded {
+		t.Errorf("expected %v last, got %+v", limiter.EventExceeded, events)
+	}
+}
+
 func TestWriteError(t *testing.T) {
 	w := readwrite.NewWriter(&errWriter{}, limiter.NewController(interval, ticks, 0, 0).BornLimiter(), false)
 
@@ -133,19 +174,37 @@ func (w *errWriter) Write(p []byte) (n int, err error) {
 
 var errPartialWrite = errors.New("partialWrite")
 
-func cp(w io.Writer, r io.Reader, n int64) time.Duration {
-	startTime := time.Now()
+// cp copies n from r to w moving m from a Timer to a Timer, and returns the time spent by m.
+func cp(m *clocktest.Manual, w io.Writer, r io.Reader, n int64) time.Duration {
+	startTime := m.Now()
+
+	done := make(chan error)
+	go func() {
+		cn, err := io.CopyN(w, r, n)
+		if err == nil && cn != n {
+			err = fmt.Errorf("expected %d, got %d: %w", n, cn, errPartialWrite)
+		}
+		done <- err
+	}()
 
-	cn, err := io.CopyN(w, r, n)
-	if err != nil {
+	if err := drive(m, done); err != nil {
 		panic(err)
 	}
 
-	if cn != n {
-		panic(fmt.Errorf("expected %d, got %d: %w", n, cn, errPartialWrite))
-	}
+	return m.Now().Sub(startTime)
+}
+
+// drive moves m from a Timer to a Timer until done receives an error and returns it.
+func drive(m *clocktest.Manual, done <-chan error) error {
+	for ; ; runtime.Gosched() {
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
 
-	return time.Now().Sub(startTime)
+		m.Next()
+	}
 }
 
 type noOpReader struct{}